@@ -2,7 +2,10 @@ package main
 
 import (
 	"log"
+	"os"
+	"time"
 
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
 	"github.com/davidcollom/k8s-ssh-router/pkg/sshserver"
 	"github.com/spf13/cobra"
 	"k8s.io/client-go/kubernetes"
@@ -11,11 +14,34 @@ import (
 )
 
 var (
-	reconcileInterval int
-	sshPort           int
-	metricsPort       int
-	namespace         string
-	privateKeyPath    string
+	reconcileInterval       int
+	sshPort                 int
+	metricsPort             int
+	namespace               string
+	privateKeyPath          string
+	advertiseAddress        string
+	keepaliveInterval       time.Duration
+	keepaliveCountMax       int
+	idleTimeout             time.Duration
+	maxSessionDuration      time.Duration
+	sftpHelperImage         string
+	maxSessions             int
+	maxSessionsPerUser      int
+	maxSessionsPerNamespace int
+	handshakeTimeout        time.Duration
+	maxAuthTries            int
+	connectionsPerMinute    int
+	maxUnauthenticated      int
+	hostKeySecret           string
+	algorithmProfile        string
+	keyExchanges            []string
+	ciphers                 []string
+	macs                    []string
+	hostKeyAlgorithms       []string
+	publicKeyAlgorithms     []string
+	crossNamespace          []string
+	impersonationPrefixes   []string
+	approvalNamespace       string
 )
 
 func main() {
@@ -32,6 +58,29 @@ func main() {
 	rootCmd.Flags().IntVar(&metricsPort, "metrics-port", 9090, "Metrics server port")
 	rootCmd.Flags().StringVar(&namespace, "namespace", "", "Kubernetes namespace")
 	rootCmd.Flags().StringVar(&privateKeyPath, "private-key", "/etc/ssh/ssh_host_rsa_key", "Path to private key")
+	rootCmd.Flags().StringVar(&hostKeySecret, "host-key-secret", "", "Secret holding the host keys, as namespace/name or a name in --namespace; watched for rotation and used instead of --private-key")
+	rootCmd.Flags().DurationVar(&keepaliveInterval, "keepalive-interval", 30*time.Second, "Interval between keepalive probes (0 disables)")
+	rootCmd.Flags().IntVar(&keepaliveCountMax, "keepalive-count-max", 3, "Unanswered keepalive probes before disconnecting")
+	rootCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "Disconnect sessions without input for this long (0 disables)")
+	rootCmd.Flags().DurationVar(&maxSessionDuration, "max-session-duration", 0, "Maximum lifetime of a session (0 disables)")
+	rootCmd.Flags().StringVar(&sftpHelperImage, "sftp-helper-image", k8s.DefaultHelperImage, "Image of the helper pods serving SFTP for PersistentVolumeClaim routes")
+	rootCmd.Flags().IntVar(&maxSessions, "max-sessions", 0, "Maximum sessions open on the router (0 is unlimited)")
+	rootCmd.Flags().IntVar(&maxSessionsPerUser, "max-sessions-per-user", 0, "Maximum sessions open per user (0 is unlimited)")
+	rootCmd.Flags().IntVar(&maxSessionsPerNamespace, "max-sessions-per-namespace", 0, "Maximum sessions open per target namespace (0 is unlimited)")
+	rootCmd.Flags().DurationVar(&handshakeTimeout, "handshake-timeout", 30*time.Second, "Time allowed for the SSH handshake and authentication (0 disables)")
+	rootCmd.Flags().IntVar(&maxAuthTries, "max-auth-tries", 6, "Failed authentication attempts allowed per connection")
+	rootCmd.Flags().IntVar(&connectionsPerMinute, "connections-per-minute", 60, "Connections accepted per client IP per minute (0 is unlimited)")
+	rootCmd.Flags().IntVar(&maxUnauthenticated, "max-unauthenticated", 100, "Connections allowed to be authenticating at once (0 is unlimited)")
+	rootCmd.Flags().StringVar(&algorithmProfile, "algorithm-profile", "default", "SSH algorithms offered: default, modern or fips")
+	rootCmd.Flags().StringSliceVar(&keyExchanges, "kex-algorithms", nil, "Key exchanges offered, replacing those of the profile")
+	rootCmd.Flags().StringSliceVar(&ciphers, "ciphers", nil, "Ciphers offered, replacing those of the profile")
+	rootCmd.Flags().StringSliceVar(&macs, "macs", nil, "MACs offered, replacing those of the profile")
+	rootCmd.Flags().StringSliceVar(&hostKeyAlgorithms, "host-key-algorithms", nil, "Host key signature algorithms offered, replacing those of the profile")
+	rootCmd.Flags().StringSliceVar(&publicKeyAlgorithms, "pubkey-algorithms", nil, "Public key algorithms accepted for user authentication, replacing those of the profile")
+	rootCmd.Flags().StringSliceVar(&crossNamespace, "allow-cross-namespace", nil, "source=target rules letting user Secrets in the source namespace route to the target namespace (* matches any)")
+	rootCmd.Flags().StringSliceVar(&impersonationPrefixes, "impersonation-prefix", nil, "Prefixes the kubernetesUser and kubernetesGroups of routes must start with (any but system: identities when empty)")
+	rootCmd.Flags().StringVar(&approvalNamespace, "approval-namespace", os.Getenv("POD_NAMESPACE"), "Namespace holding access requests of routes that require approval (the user Secret's namespace when empty)")
+	rootCmd.Flags().StringVar(&advertiseAddress, "advertise-address", os.Getenv("POD_IP"), "Router pod IP published for remote port forwards (disabled when empty)")
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("Error executing root command: %v", err)
@@ -52,5 +101,34 @@ func RunServer() {
 		log.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
 
-	sshserver.RunServer(reconcileInterval, sshPort, metricsPort, namespace, privateKeyPath, clientset, k8sConfig)
+	sshserver.RunServer(sshserver.Options{
+		ReconcileInterval:       reconcileInterval,
+		SSHPort:                 sshPort,
+		MetricsPort:             metricsPort,
+		Namespace:               namespace,
+		PrivateKeyPath:          privateKeyPath,
+		HostKeySecret:           hostKeySecret,
+		AlgorithmProfile:        algorithmProfile,
+		KeyExchanges:            keyExchanges,
+		Ciphers:                 ciphers,
+		MACs:                    macs,
+		HostKeyAlgorithms:       hostKeyAlgorithms,
+		PublicKeyAlgorithms:     publicKeyAlgorithms,
+		AdvertiseAddress:        advertiseAddress,
+		KeepaliveInterval:       keepaliveInterval,
+		KeepaliveCountMax:       keepaliveCountMax,
+		IdleTimeout:             idleTimeout,
+		MaxSessionDuration:      maxSessionDuration,
+		SFTPHelperImage:         sftpHelperImage,
+		MaxSessions:             maxSessions,
+		MaxSessionsPerUser:      maxSessionsPerUser,
+		MaxSessionsPerNamespace: maxSessionsPerNamespace,
+		HandshakeTimeout:        handshakeTimeout,
+		MaxAuthTries:            maxAuthTries,
+		ConnectionsPerMinute:    connectionsPerMinute,
+		MaxUnauthenticated:      maxUnauthenticated,
+		CrossNamespace:          crossNamespace,
+		ImpersonationPrefixes:   impersonationPrefixes,
+		ApprovalNamespace:       approvalNamespace,
+	}, clientset, k8sConfig)
 }
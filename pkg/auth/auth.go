@@ -4,6 +4,7 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
 
@@ -49,6 +50,11 @@ func authenticateUser(username, password, publicKey string) error {
 		return fmt.Errorf("user secret must contain either a password or a publicKey")
 	}
 
+	// Refuse logins outside the route's access schedule
+	if _, err := k8s.CheckSchedule(username, time.Now()); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// accessCache holds SubjectAccessReview decisions, denials included, so a
+// busy session does not review every command.
+var accessCache = cache.New(30*time.Second, time.Minute)
+
+// Pod operations checked with CheckPodAccess.
+const (
+	PodExec        = "exec"
+	PodPortForward = "portforward"
+	PodLog         = "log"
+)
+
+// CheckPodAccess asks the apiserver whether the route's kubernetesUser may use
+// subresource of the target pod, so per-person RBAC applies even though the
+// router's ServiceAccount could do it. Routes without a kubernetesUser are not
+// checked. An empty target.Pod checks every pod in the namespace.
+func CheckPodAccess(clientset kubernetes.Interface, secret map[string]string, target Target, subresource string) error {
+	if secret["kubernetesUser"] == "" {
+		return nil
+	}
+	user, groups, err := routeIdentity(secret)
+	if err != nil {
+		return err
+	}
+	verb := "create"
+	if subresource == PodLog {
+		verb = "get"
+	}
+
+	key := strings.Join([]string{user, strings.Join(groups, ","), verb, target.Namespace, target.Pod, subresource}, "\x00")
+	if reason, found := accessCache.Get(key); found {
+		return accessError(user, verb, subresource, target, reason.(string))
+	}
+
+	review, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(context.TODO(), &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user,
+			Groups: groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   target.Namespace,
+				Verb:        verb,
+				Resource:    "pods",
+				Subresource: subresource,
+				Name:        target.Pod,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to review access of %s: %v", user, err)
+	}
+
+	// An empty reason means allowed
+	reason := ""
+	if !review.Status.Allowed {
+		reason = review.Status.Reason
+		if reason == "" {
+			reason = "no RBAC rule allows it"
+		}
+	}
+	accessCache.Set(key, reason, cache.DefaultExpiration)
+	return accessError(user, verb, subresource, target, reason)
+}
+
+func accessError(user, verb, subresource string, target Target, reason string) error {
+	if reason == "" {
+		return nil
+	}
+	object := "pods"
+	if target.Pod != "" {
+		object += "/" + target.Pod
+	}
+	return fmt.Errorf("%s may not %s %s/%s in namespace %s: %s", user, verb, object, subresource, target.Namespace, reason)
+}
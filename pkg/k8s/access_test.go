@@ -0,0 +1,53 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestCheckPodAccess(t *testing.T) {
+	clientset := clientFake.NewSimpleClientset()
+	var reviews []authorizationv1.SubjectAccessReviewSpec
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviews = append(reviews, review.Spec)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Subresource == PodLog
+		if !review.Status.Allowed {
+			review.Status.Reason = "RBAC: denied"
+		}
+		return true, review, nil
+	})
+	secret := map[string]string{"kubernetesUser": "erin@example.com", "kubernetesGroups": "ops"}
+	target := Target{Namespace: "web", Pod: "web-1", Container: "app"}
+
+	require.NoError(t, CheckPodAccess(clientset, secret, target, PodLog))
+	require.Len(t, reviews, 1)
+	assert.Equal(t, "erin@example.com", reviews[0].User)
+	assert.Equal(t, []string{"ops"}, reviews[0].Groups)
+	assert.Equal(t, authorizationv1.ResourceAttributes{
+		Namespace:   "web",
+		Verb:        "get",
+		Resource:    "pods",
+		Subresource: "log",
+		Name:        "web-1",
+	}, *reviews[0].ResourceAttributes)
+
+	err := CheckPodAccess(clientset, secret, target, PodExec)
+	assert.EqualError(t, err, "erin@example.com may not create pods/web-1/exec in namespace web: RBAC: denied")
+	assert.Equal(t, "create", reviews[1].ResourceAttributes.Verb)
+
+	// Decisions are cached, denials included
+	require.NoError(t, CheckPodAccess(clientset, secret, target, PodLog))
+	assert.Error(t, CheckPodAccess(clientset, secret, target, PodExec))
+	assert.Len(t, reviews, 2)
+
+	// Routes without a user are left to the router's own permissions
+	assert.NoError(t, CheckPodAccess(clientset, map[string]string{}, target, PodExec))
+	assert.Len(t, reviews, 2)
+}
@@ -0,0 +1,208 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Access requests are ConfigMaps in the router's namespace, or the route
+// Secret's when none is configured. Approvers decide by setting the approval
+// annotation:
+//
+//	kubectl annotate configmap <name> ssh-router/approval=approved --overwrite
+//
+// The router records when it saw the approval in approved-at, which bounds
+// how long the request can be reused.
+const (
+	accessRequestLabel   = "ssh-router/access-request"
+	accessUserLabel      = "ssh-router/access-user"
+	approvalAnnotation   = "ssh-router/approval"
+	approvedByAnnotation = "ssh-router/approved-by"
+	approvedAtAnnotation = "ssh-router/approved-at"
+	expiresAnnotation    = "ssh-router/expires-at"
+
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalDenied   = "denied"
+	ApprovalExpired  = "expired"
+)
+
+// Defaults for routes that do not set approvalTTL or approvalTimeout.
+const (
+	DefaultApprovalTTL     = time.Hour
+	DefaultApprovalTimeout = 10 * time.Minute
+)
+
+var approvalPollInterval = 2 * time.Second
+
+// ErrAccessDenied is returned when an approver denies an access request.
+var ErrAccessDenied = errors.New("access request denied")
+
+// AccessRequest identifies a user's request for access. Expires and
+// ApprovedBy are set once it has been approved.
+type AccessRequest struct {
+	Namespace  string
+	Name       string
+	Expires    time.Time
+	ApprovedBy string
+}
+
+func (r AccessRequest) String() string {
+	return r.Namespace + "/" + r.Name
+}
+
+// RequiresApproval reports whether the user's route needs an approved access
+// request before any session starts.
+func RequiresApproval(username string) bool {
+	secret, err := GetUserSecret(username)
+	return err == nil && secret["requireApproval"] == "true"
+}
+
+// RequestAccess returns an access request of the user approved less than ttl
+// ago if there is one, so reconnecting during an incident needs no new
+// approval. Otherwise it records a new pending request. Requests are kept in
+// namespace, or in the namespace of the route's Secret when it is empty; never
+// in the route's service namespace, which the Secret's author chooses.
+func RequestAccess(clientset kubernetes.Interface, namespace, username string, ttl time.Duration) (AccessRequest, error) {
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return AccessRequest{}, err
+	}
+	if namespace == "" {
+		namespace = secret["secretNamespace"]
+		if err := CheckNamespace(secret, namespace); err != nil {
+			return AccessRequest{}, err
+		}
+	}
+	user := sanitizeName(username)
+
+	requests, err := clientset.CoreV1().ConfigMaps(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s=true,%s=%s", managedByLabel, managedByValue, accessRequestLabel, accessUserLabel, user),
+	})
+	if err != nil {
+		return AccessRequest{}, fmt.Errorf("failed to list access requests: %v", err)
+	}
+	for _, request := range requests.Items {
+		if request.Annotations[approvalAnnotation] != ApprovalApproved || request.Data["user"] != username {
+			continue
+		}
+		if expires, ok := approvalExpiry(request, ttl); ok {
+			return AccessRequest{Namespace: namespace, Name: request.Name, Expires: expires, ApprovedBy: request.Annotations[approvedByAnnotation]}, nil
+		}
+	}
+
+	name := strings.TrimRight(fmt.Sprintf("ssh-access-%.45s", user), "-") + "-" + utilrand.String(5)
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				managedByLabel:     managedByValue,
+				accessRequestLabel: "true",
+				accessUserLabel:    user,
+			},
+			Annotations: map[string]string{
+				approvalAnnotation: ApprovalPending,
+			},
+		},
+		Data: map[string]string{
+			"user":        username,
+			"requestedAt": time.Now().UTC().Format(time.RFC3339),
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return AccessRequest{}, fmt.Errorf("failed to create access request: %v", err)
+	}
+	return AccessRequest{Namespace: namespace, Name: name}, nil
+}
+
+// WaitForApproval polls the request until an approver decides or ctx ends.
+// An approval is valid for ttl, unless the approver set an earlier
+// expires-at annotation themselves. Requests nobody decided on in time are
+// marked expired so they cannot be approved afterwards.
+func WaitForApproval(ctx context.Context, clientset kubernetes.Interface, request AccessRequest, ttl time.Duration) (AccessRequest, error) {
+	configMaps := clientset.CoreV1().ConfigMaps(request.Namespace)
+	ticker := time.NewTicker(approvalPollInterval)
+	defer ticker.Stop()
+	for {
+		current, err := configMaps.Get(context.TODO(), request.Name, metav1.GetOptions{})
+		if err != nil {
+			return request, fmt.Errorf("failed to read access request %s: %v", request, err)
+		}
+
+		switch current.Annotations[approvalAnnotation] {
+		case ApprovalApproved:
+			request.ApprovedBy = current.Annotations[approvedByAnnotation]
+			now := time.Now()
+			request.Expires = now.Add(ttl)
+			if expires, err := time.Parse(time.RFC3339, current.Annotations[expiresAnnotation]); err == nil && expires.Before(request.Expires) {
+				request.Expires = expires
+			}
+			current.Annotations[approvedAtAnnotation] = now.UTC().Format(time.RFC3339)
+			current.Annotations[expiresAnnotation] = request.Expires.UTC().Format(time.RFC3339)
+			if _, err := configMaps.Update(context.TODO(), current, metav1.UpdateOptions{}); err != nil {
+				return request, fmt.Errorf("failed to record approval of %s: %v", request, err)
+			}
+			return request, nil
+		case ApprovalDenied:
+			return request, ErrAccessDenied
+		case ApprovalExpired:
+			return request, fmt.Errorf("access request %s expired", request)
+		}
+
+		select {
+		case <-ctx.Done():
+			if current.Annotations == nil {
+				current.Annotations = make(map[string]string)
+			}
+			current.Annotations[approvalAnnotation] = ApprovalExpired
+			if _, err := configMaps.Update(context.TODO(), current, metav1.UpdateOptions{}); err != nil {
+				return request, fmt.Errorf("failed to expire access request %s: %v", request, err)
+			}
+			return request, fmt.Errorf("access request %s was not approved in time", request)
+		case <-ticker.C:
+		}
+	}
+}
+
+// approvalExpiry returns when an approved request stops granting access: ttl
+// after the router recorded the approval, or at the earlier expires-at. It
+// reports false once that has passed, and for requests without a recorded
+// approval time.
+func approvalExpiry(request corev1.ConfigMap, ttl time.Duration) (time.Time, bool) {
+	now := time.Now()
+	approvedAt, err := time.Parse(time.RFC3339, request.Annotations[approvedAtAnnotation])
+	if err != nil || approvedAt.After(now) {
+		return time.Time{}, false
+	}
+	expires := approvedAt.Add(ttl)
+	if earlier, err := time.Parse(time.RFC3339, request.Annotations[expiresAnnotation]); err == nil && earlier.Before(expires) {
+		expires = earlier
+	}
+	return expires, now.Before(expires)
+}
+
+// ApprovalDurations returns how long an approval lasts and how long a login
+// waits for one, from the route's approvalTTL and approvalTimeout.
+func ApprovalDurations(username string) (ttl, timeout time.Duration) {
+	ttl, timeout = DefaultApprovalTTL, DefaultApprovalTimeout
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return ttl, timeout
+	}
+	if d, err := time.ParseDuration(secret["approvalTTL"]); err == nil && d > 0 {
+		ttl = d
+	}
+	if d, err := time.ParseDuration(secret["approvalTimeout"]); err == nil && d > 0 {
+		timeout = d
+	}
+	return ttl, timeout
+}
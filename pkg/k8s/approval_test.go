@@ -0,0 +1,140 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAccessRequestApproval(t *testing.T) {
+	approvalPollInterval = 10 * time.Millisecond
+	SetSecretInCache("prod-oncall", map[string]string{
+		"service":         "prod",
+		"secretNamespace": "prod",
+		"requireApproval": "true",
+		"approvalTTL":     "30m",
+		"approvalTimeout": "5m",
+	})
+	assert.True(t, RequiresApproval("prod-oncall"))
+	ttl, timeout := ApprovalDurations("prod-oncall")
+	assert.Equal(t, 30*time.Minute, ttl)
+	assert.Equal(t, 5*time.Minute, timeout)
+
+	clientset := clientFake.NewSimpleClientset()
+	request, err := RequestAccess(clientset, "", "prod-oncall", ttl)
+	require.NoError(t, err)
+	assert.Equal(t, "prod", request.Namespace)
+	assert.Regexp(t, "^ssh-access-prod-oncall-", request.Name)
+	assert.True(t, request.Expires.IsZero(), "New requests are pending")
+
+	configMaps := clientset.CoreV1().ConfigMaps("prod")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		record, err := configMaps.Get(context.TODO(), request.Name, metav1.GetOptions{})
+		if err != nil {
+			return
+		}
+		record.Annotations[approvalAnnotation] = ApprovalApproved
+		record.Annotations[approvedByAnnotation] = "sre-lead"
+		configMaps.Update(context.TODO(), record, metav1.UpdateOptions{})
+	}()
+
+	approved, err := WaitForApproval(context.Background(), clientset, request, ttl)
+	require.NoError(t, err)
+	assert.Equal(t, "sre-lead", approved.ApprovedBy)
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), approved.Expires, time.Minute)
+
+	record, err := configMaps.Get(context.TODO(), request.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, record.Annotations[expiresAnnotation], "The expiry is recorded on the request")
+	assert.NotEmpty(t, record.Annotations[approvedAtAnnotation], "The approval time is recorded on the request")
+
+	// Logins while the approval lasts reuse it
+	again, err := RequestAccess(clientset, "", "prod-oncall", ttl)
+	require.NoError(t, err)
+	assert.Equal(t, request.Name, again.Name)
+	assert.False(t, again.Expires.IsZero())
+}
+
+func TestAccessRequestReuseIsCapped(t *testing.T) {
+	SetSecretInCache("prod-oncall", map[string]string{"service": "prod", "requireApproval": "true"})
+	approvedAt := time.Now().Add(-2 * time.Hour).UTC()
+	forged := func(name string, annotations map[string]string) *corev1.ConfigMap {
+		annotations[approvalAnnotation] = ApprovalApproved
+		annotations[expiresAnnotation] = time.Now().Add(24 * 365 * time.Hour).UTC().Format(time.RFC3339)
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "ssh-router",
+				Labels:      map[string]string{managedByLabel: managedByValue, accessRequestLabel: "true", accessUserLabel: "prod-oncall"},
+				Annotations: annotations,
+			},
+			Data: map[string]string{"user": "prod-oncall"},
+		}
+	}
+	clientset := clientFake.NewSimpleClientset(
+		forged("never-recorded", map[string]string{}),
+		forged("approved-long-ago", map[string]string{approvedAtAnnotation: approvedAt.Format(time.RFC3339)}),
+		forged("approved-in-future", map[string]string{approvedAtAnnotation: time.Now().Add(time.Hour).UTC().Format(time.RFC3339)}),
+	)
+
+	request, err := RequestAccess(clientset, "ssh-router", "prod-oncall", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-router", request.Namespace, "Requests are kept in the router's namespace")
+	assert.True(t, request.Expires.IsZero(), "Approvals are not reused past their TTL whatever expires-at says")
+
+	request, err = RequestAccess(clientset, "ssh-router", "prod-oncall", 3*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "approved-long-ago", request.Name)
+	assert.WithinDuration(t, approvedAt.Add(3*time.Hour), request.Expires, time.Second)
+}
+
+func TestAccessRequestDeniedAndExpired(t *testing.T) {
+	approvalPollInterval = 10 * time.Millisecond
+	SetSecretInCache("prod-intruder", map[string]string{"service": "prod", "secretNamespace": "prod", "requireApproval": "true"})
+	clientset := clientFake.NewSimpleClientset()
+	configMaps := clientset.CoreV1().ConfigMaps("prod")
+
+	request, err := RequestAccess(clientset, "", "prod-intruder", time.Hour)
+	require.NoError(t, err)
+	record, err := configMaps.Get(context.TODO(), request.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	record.Annotations[approvalAnnotation] = ApprovalDenied
+	_, err = configMaps.Update(context.TODO(), record, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	_, err = WaitForApproval(context.Background(), clientset, request, time.Hour)
+	assert.ErrorIs(t, err, ErrAccessDenied)
+
+	request, err = RequestAccess(clientset, "", "prod-intruder", time.Hour)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = WaitForApproval(ctx, clientset, request, time.Hour)
+	assert.ErrorContains(t, err, "was not approved in time")
+
+	record, err = configMaps.Get(context.TODO(), request.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, ApprovalExpired, record.Annotations[approvalAnnotation], "Stale requests cannot be approved later")
+}
+
+func TestAccessRequestIgnoresServiceNamespace(t *testing.T) {
+	SetSecretInCache("team-a-mallory", map[string]string{"service": "kube-system", "secretNamespace": "team-a", "requireApproval": "true"})
+	clientset := clientFake.NewSimpleClientset()
+
+	request, err := RequestAccess(clientset, "", "team-a-mallory", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "team-a", request.Namespace, "Requests fall back to the Secret's namespace, not the route's target")
+	requests, err := clientset.CoreV1().ConfigMaps("kube-system").List(context.TODO(), metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, requests.Items)
+
+	SetSecretInCache("default-orphan", map[string]string{"service": "kube-system", "requireApproval": "true"})
+	_, err = RequestAccess(clientset, "", "default-orphan", time.Hour)
+	assert.Error(t, err, "Routes without a Secret namespace cannot be approved anywhere")
+}
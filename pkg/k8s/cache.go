@@ -1,6 +1,7 @@
 package k8s
 
 import (
+	"fmt"
 	"log"
 	"time"
 
@@ -13,6 +14,15 @@ func GetSecretFromCache(username string) (interface{}, bool) {
 	return localCache.Get(username)
 }
 
+// GetUserSecret returns the route stored for username.
+func GetUserSecret(username string) (map[string]string, error) {
+	userSecret, found := GetSecretFromCache(username)
+	if !found {
+		return nil, fmt.Errorf("user secret not found in cache")
+	}
+	return userSecret.(map[string]string), nil
+}
+
 func SetSecretInCache(username string, secretData map[string]string) {
 	localCache.Set(username, secretData, cache.DefaultExpiration)
 	log.Printf("Processed secret: %s, cache size: %d\n", username, localCache.ItemCount())
@@ -0,0 +1,107 @@
+package k8s
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// shellMeta are the characters a glob wildcard will not match, so a pattern
+// like "pg_dump *" cannot be extended with "; sh" since commands run through
+// the route's shell.
+const shellMeta = ";&|`$()<>\n\r"
+
+// RouteCommand applies the route's command rules to an exec request and
+// returns what should run: forceCommand when set, otherwise command if no
+// denyCommands pattern matches it and allowCommands is empty or matches it.
+// An empty command is an interactive shell, which an allow list refuses.
+func RouteCommand(username, command string) (string, error) {
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return "", err
+	}
+	if forced := strings.TrimSpace(secret["forceCommand"]); forced != "" {
+		return forced, nil
+	}
+
+	deny, err := commandPatterns(secret["denyCommands"])
+	if err != nil {
+		return "", err
+	}
+	allow, err := commandPatterns(secret["allowCommands"])
+	if err != nil {
+		return "", err
+	}
+
+	trimmed := strings.TrimSpace(command)
+	for _, pattern := range deny {
+		if pattern.MatchString(trimmed) {
+			return "", fmt.Errorf("command %q is not allowed", trimmed)
+		}
+	}
+	if len(allow) == 0 {
+		return command, nil
+	}
+	if trimmed == "" {
+		return "", fmt.Errorf("interactive shells are not allowed")
+	}
+	for _, pattern := range allow {
+		if pattern.MatchString(trimmed) {
+			return command, nil
+		}
+	}
+	return "", fmt.Errorf("command %q is not allowed", trimmed)
+}
+
+// CommandsRestricted reports whether the route limits what may run, in which
+// case subsystems such as SFTP are refused as well.
+func CommandsRestricted(username string) bool {
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(secret["forceCommand"]) != "" || strings.TrimSpace(secret["allowCommands"]) != ""
+}
+
+// commandPatterns compiles a newline separated list of command patterns.
+// Entries are globs where * and ? match anything but shell metacharacters;
+// entries starting with "re:" are regular expressions. Both must match the
+// whole command.
+func commandPatterns(list string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, entry := range strings.Split(list, "\n") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var expr string
+		if re, ok := strings.CutPrefix(entry, "re:"); ok {
+			expr = "^(?:" + re + ")$"
+		} else {
+			expr = "^" + globExpr(entry) + "$"
+		}
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid command pattern %q: %v", entry, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func globExpr(glob string) string {
+	anything := "[^" + regexp.QuoteMeta(shellMeta) + "]"
+	var expr strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(anything + "*")
+		case '?':
+			expr.WriteString(anything)
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return expr.String()
+}
@@ -0,0 +1,55 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteCommand(t *testing.T) {
+	SetSecretInCache("ops-robot", map[string]string{
+		"allowCommands": "./healthcheck\npg_dump *\nre:tail -n [0-9]+ /var/log/app\\.log",
+		"denyCommands":  "pg_dump * --no-acl*",
+	})
+	SetSecretInCache("ops-forced", map[string]string{"forceCommand": "/usr/local/bin/menu"})
+	SetSecretInCache("ops-human", map[string]string{"denyCommands": "re:.*\\brm\\b.*"})
+
+	for _, test := range []struct {
+		user, command, want string
+		allowed             bool
+	}{
+		{"ops-robot", "./healthcheck", "./healthcheck", true},
+		{"ops-robot", "pg_dump -Fc orders", "pg_dump -Fc orders", true},
+		{"ops-robot", "tail -n 100 /var/log/app.log", "tail -n 100 /var/log/app.log", true},
+		{"ops-robot", "pg_dump orders; sh", "", false},
+		{"ops-robot", "pg_dump orders $(id)", "", false},
+		{"ops-robot", "pg_dump orders --no-acl", "", false},
+		{"ops-robot", "./healthcheck --verbose", "", false},
+		{"ops-robot", "", "", false},
+		{"ops-forced", "bash", "/usr/local/bin/menu", true},
+		{"ops-forced", "", "/usr/local/bin/menu", true},
+		{"ops-human", "", "", true},
+		{"ops-human", "ls -la", "ls -la", true},
+		{"ops-human", "rm -rf /tmp/x", "", false},
+	} {
+		command, err := RouteCommand(test.user, test.command)
+		if test.allowed {
+			assert.NoError(t, err, "%s: %q", test.user, test.command)
+			assert.Equal(t, test.want, command, "%s: %q", test.user, test.command)
+		} else {
+			assert.Error(t, err, "%s: %q", test.user, test.command)
+		}
+	}
+
+	assert.True(t, CommandsRestricted("ops-robot"))
+	assert.True(t, CommandsRestricted("ops-forced"))
+	assert.False(t, CommandsRestricted("ops-human"), "Deny lists alone leave subsystems available")
+}
+
+func TestRouteCommandInvalidPattern(t *testing.T) {
+	SetSecretInCache("ops-broken", map[string]string{"allowCommands": "re:("})
+	_, err := RouteCommand("ops-broken", "ls")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid command pattern")
+}
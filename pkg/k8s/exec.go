@@ -1,12 +1,12 @@
 package k8s
 
 import (
-	"context"
 	"fmt"
+	"io"
+	"net/url"
 	"strconv"
 
 	"golang.org/x/crypto/ssh"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
@@ -16,37 +16,45 @@ type Executor interface {
 	Stream(options remotecommand.StreamOptions) error
 }
 
+// ExecutorFactory builds an Executor for a pods/exec request URL.
+type ExecutorFactory func(config *rest.Config, method string, url *url.URL) (Executor, error)
+
+// NewSPDYExecutor is the ExecutorFactory used against a real cluster.
+func NewSPDYExecutor(config *rest.Config, method string, url *url.URL) (Executor, error) {
+	return remotecommand.NewSPDYExecutor(config, method, url)
+}
+
 func ExecInPod(clientset kubernetes.Interface, restClient rest.Interface, executor Executor, config *rest.Config, username, command string, conn ssh.Channel, isTerminal bool) error {
 	fmt.Printf("Cache: %v \n", localCache.ItemCount())
-	userSecret, found := GetSecretFromCache(username)
-	if !found {
-		return fmt.Errorf("user secret not found in cache")
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return err
+	}
+
+	if config, err = SessionConfig(config, secret); err != nil {
+		return err
 	}
-	secret := userSecret.(map[string]string)
 
-	service := secret["service"]
-	podLabelSelector := secret["podLabelSelector"]
-	containerName := secret["containerName"]
 	shell := secret["shell"]
 	if shell == "" {
 		shell = "/bin/sh"
 	}
 
-	pods, err := clientset.CoreV1().Pods(service).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: podLabelSelector,
-	})
-	if err != nil || len(pods.Items) == 0 {
-		return fmt.Errorf("failed to list pods: %v", err)
+	target, err := ResolveTarget(clientset, secret)
+	if err != nil {
+		return err
+	}
+	if err := CheckPodAccess(clientset, secret, target, PodExec); err != nil {
+		return err
 	}
-	pod := pods.Items[0]
 
 	req := restClient.
 		Post().
 		Resource("pods").
-		Name(pod.Name).
-		Namespace(pod.Namespace).
+		Name(target.Pod).
+		Namespace(target.Namespace).
 		SubResource("exec").
-		Param("container", containerName).
+		Param("container", target.Container).
 		Param("stdin", "true").
 		Param("stdout", "true").
 		Param("stderr", "true").
@@ -58,6 +66,12 @@ func ExecInPod(clientset kubernetes.Interface, restClient rest.Interface, execut
 		req.Param("command", shell)
 	}
 
+	if executor == nil {
+		if executor, err = remotecommand.NewSPDYExecutor(config, "POST", req.URL()); err != nil {
+			return err
+		}
+	}
+
 	return executor.Stream(remotecommand.StreamOptions{
 		Stdin:  conn,
 		Stdout: conn,
@@ -65,3 +79,35 @@ func ExecInPod(clientset kubernetes.Interface, restClient rest.Interface, execut
 		Tty:    isTerminal,
 	})
 }
+
+// StreamInPod runs command in the target container without a TTY, wiring up
+// the given streams. A nil executor builds an SPDY executor from config.
+func StreamInPod(restClient rest.Interface, executor Executor, config *rest.Config, target Target, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	req := restClient.
+		Post().
+		Resource("pods").
+		Name(target.Pod).
+		Namespace(target.Namespace).
+		SubResource("exec").
+		Param("container", target.Container).
+		Param("stdin", strconv.FormatBool(stdin != nil)).
+		Param("stdout", strconv.FormatBool(stdout != nil)).
+		Param("stderr", strconv.FormatBool(stderr != nil)).
+		Param("tty", "false")
+	for _, arg := range command {
+		req.Param("command", arg)
+	}
+
+	if executor == nil {
+		var err error
+		if executor, err = remotecommand.NewSPDYExecutor(config, "POST", req.URL()); err != nil {
+			return err
+		}
+	}
+
+	return executor.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
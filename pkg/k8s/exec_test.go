@@ -25,6 +25,7 @@ func initTestCache() {
 		"password":         "testpassword",
 		"publicKey":        "testpublickey",
 		"service":          "default",
+		"secretNamespace":  "default",
 		"podLabelSelector": "testpodlabelselector",
 		"containerName":    "testcontainer",
 		"shell":            "/bin/sh",
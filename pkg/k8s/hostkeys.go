@@ -0,0 +1,85 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// hostKeyRewatchDelay is how long WatchHostKeys waits before watching again
+// after the apiserver ends a watch.
+var hostKeyRewatchDelay = 5 * time.Second
+
+// WatchHostKeys calls update with the data of the named Secret, once before
+// returning and again whenever the Secret changes, until ctx ends. Deleting
+// the Secret keeps the keys last seen, so replicas keep serving while it is
+// recreated.
+func WatchHostKeys(ctx context.Context, clientset kubernetes.Interface, namespace, name string, update func(map[string][]byte) error) error {
+	secrets := clientset.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get host key secret %s/%s: %v", namespace, name, err)
+	}
+	if err := update(secret.Data); err != nil {
+		return fmt.Errorf("invalid host key secret %s/%s: %v", namespace, name, err)
+	}
+
+	go func() {
+		resourceVersion := secret.ResourceVersion
+		for ctx.Err() == nil {
+			watcher, err := secrets.Watch(ctx, metav1.ListOptions{
+				FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+				ResourceVersion: resourceVersion,
+			})
+			if err != nil {
+				log.Printf("Failed to watch host key secret %s/%s: %v", namespace, name, err)
+				// Start over from the current version
+				resourceVersion = ""
+			} else {
+				resourceVersion = watchHostKeys(watcher, name, resourceVersion, update)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(hostKeyRewatchDelay):
+			}
+		}
+	}()
+	return nil
+}
+
+// watchHostKeys applies the events of one watch and returns the resource
+// version to watch from next.
+func watchHostKeys(watcher watch.Interface, name, resourceVersion string, update func(map[string][]byte) error) string {
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		if event.Type == watch.Error {
+			// Usually an expired resource version
+			log.Printf("Watch of host key secret %s failed: %v", name, event.Object)
+			return ""
+		}
+		secret, ok := event.Object.(*corev1.Secret)
+		if !ok || secret.Name != name {
+			continue
+		}
+		resourceVersion = secret.ResourceVersion
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			if err := update(secret.Data); err != nil {
+				log.Printf("Keeping the current host keys, %s/%s is invalid: %v", secret.Namespace, name, err)
+				continue
+			}
+			log.Printf("Loaded host keys from %s/%s", secret.Namespace, name)
+		case watch.Deleted:
+			log.Printf("Host key secret %s/%s was deleted, keeping the current host keys", secret.Namespace, name)
+		}
+	}
+	return resourceVersion
+}
@@ -0,0 +1,102 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// hostKeyUpdates records the data WatchHostKeys passes on, refusing entries
+// named "invalid".
+type hostKeyUpdates struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func (u *hostKeyUpdates) update(data map[string][]byte) error {
+	if _, ok := data["invalid"]; ok {
+		return fmt.Errorf("invalid key")
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.applied = append(u.applied, string(data["key"]))
+	return nil
+}
+
+func (u *hostKeyUpdates) seen() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.applied...)
+}
+
+func hostKeySecret(name, key string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ssh-router", ResourceVersion: key},
+		Data:       map[string][]byte{"key": []byte(key)},
+	}
+}
+
+func TestWatchHostKeys(t *testing.T) {
+	defer func(delay time.Duration) { hostKeyRewatchDelay = delay }(hostKeyRewatchDelay)
+	hostKeyRewatchDelay = 10 * time.Millisecond
+
+	clientset := fake.NewSimpleClientset(hostKeySecret("host-keys", "v1"))
+	watchers := make(chan *watch.FakeWatcher, 2)
+	var resourceVersions []string
+	clientset.PrependWatchReactor("secrets", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		resourceVersions = append(resourceVersions, action.(k8stesting.WatchActionImpl).WatchRestrictions.ResourceVersion)
+		watcher := watch.NewFake()
+		watchers <- watcher
+		return true, watcher, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := &hostKeyUpdates{}
+	require.NoError(t, WatchHostKeys(ctx, clientset, "ssh-router", "host-keys", updates.update))
+	assert.Equal(t, []string{"v1"}, updates.seen(), "Keys are loaded before returning")
+
+	watcher := <-watchers
+	watcher.Modify(hostKeySecret("other-secret", "v2"))
+	watcher.Modify(hostKeySecret("host-keys", "v3"))
+	invalid := hostKeySecret("host-keys", "v4")
+	invalid.Data["invalid"] = []byte("x")
+	watcher.Modify(invalid)
+	watcher.Delete(hostKeySecret("host-keys", "v5"))
+	assert.Eventually(t, func() bool { return len(updates.seen()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"v1", "v3"}, updates.seen(), "Other secrets, invalid keys and deletions keep the current keys")
+
+	// The apiserver ends the watch; it resumes where it left off
+	watcher.Stop()
+	watcher = <-watchers
+	watcher.Add(hostKeySecret("host-keys", "v6"))
+	assert.Eventually(t, func() bool { return len(updates.seen()) == 3 }, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Equal(t, []string{"v1", "v5"}, resourceVersions)
+}
+
+func TestWatchHostKeysMissingSecret(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	err := WatchHostKeys(context.Background(), clientset, "ssh-router", "host-keys", (&hostKeyUpdates{}).update)
+	assert.ErrorContains(t, err, "failed to get host key secret ssh-router/host-keys")
+
+	clientset = fake.NewSimpleClientset(hostKeySecret("host-keys", "v1"))
+	clientset.PrependReactor("get", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		secret := hostKeySecret("host-keys", "v1")
+		secret.Data["invalid"] = []byte("x")
+		return true, secret, nil
+	})
+	err = WatchHostKeys(context.Background(), clientset, "ssh-router", "host-keys", (&hostKeyUpdates{}).update)
+	assert.ErrorContains(t, err, "invalid host key secret")
+}
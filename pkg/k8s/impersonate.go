@@ -0,0 +1,120 @@
+package k8s
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// systemPrefix starts the users and groups of the cluster's own components and
+// ServiceAccounts, which routes may never impersonate.
+const systemPrefix = "system:"
+
+var (
+	impersonationPrefixesMu sync.RWMutex
+	impersonationPrefixes   []string
+)
+
+// SetImpersonationPrefixes limits the users and groups routes may impersonate
+// to those starting with one of prefixes. Without any, every identity outside
+// system: is allowed.
+func SetImpersonationPrefixes(prefixes []string) {
+	impersonationPrefixesMu.Lock()
+	defer impersonationPrefixesMu.Unlock()
+	impersonationPrefixes = prefixes
+}
+
+// checkIdentity returns an error unless a route may impersonate name, a user
+// or group taken from a Secret its author fully controls.
+func checkIdentity(kind, name string) error {
+	if strings.HasPrefix(name, systemPrefix) {
+		return fmt.Errorf("routes may not impersonate %s %q", kind, name)
+	}
+	impersonationPrefixesMu.RLock()
+	defer impersonationPrefixesMu.RUnlock()
+	if len(impersonationPrefixes) == 0 {
+		return nil
+	}
+	for _, prefix := range impersonationPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q does not match any impersonation prefix", kind, name)
+}
+
+// routeIdentity returns the route's kubernetesUser and kubernetesGroups, or an
+// error when the router refuses to impersonate any of them.
+func routeIdentity(secret map[string]string) (string, []string, error) {
+	user := secret["kubernetesUser"]
+	if user == "" {
+		return "", nil, fmt.Errorf("route has no kubernetesUser to impersonate")
+	}
+	if err := checkIdentity("user", user); err != nil {
+		return "", nil, err
+	}
+	groups := userGroups(secret)
+	for _, group := range groups {
+		if err := checkIdentity("group", group); err != nil {
+			return "", nil, err
+		}
+	}
+	return user, groups, nil
+}
+
+// ImpersonationConfig returns a copy of config acting as the Kubernetes
+// identity named by the user's route in kubernetesUser and kubernetesGroups.
+func ImpersonationConfig(config *rest.Config, secret map[string]string) (*rest.Config, error) {
+	user, groups, err := routeIdentity(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	impersonated := rest.CopyConfig(config)
+	impersonated.Impersonate = rest.ImpersonationConfig{
+		UserName: user,
+		Groups:   groups,
+	}
+	return impersonated, nil
+}
+
+// userGroups returns the route's comma separated kubernetesGroups.
+func userGroups(secret map[string]string) []string {
+	var groups []string
+	for _, group := range strings.Split(secret["kubernetesGroups"], ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// SessionConfig returns the config a user's pods/exec, portforward and log
+// calls are made with: one impersonating the route's kubernetesUser, so RBAC
+// and the audit log see the person, or config itself for routes naming none.
+func SessionConfig(config *rest.Config, secret map[string]string) (*rest.Config, error) {
+	if secret["kubernetesUser"] == "" {
+		return config, nil
+	}
+	return ImpersonationConfig(config, secret)
+}
+
+// SessionClientset is SessionConfig for calls made through a clientset.
+func SessionClientset(clientset kubernetes.Interface, config *rest.Config, secret map[string]string) (kubernetes.Interface, error) {
+	if secret["kubernetesUser"] == "" {
+		return clientset, nil
+	}
+	return ImpersonatedClientset(config, secret)
+}
+
+// ImpersonatedClientset returns a clientset acting as the route's Kubernetes identity.
+func ImpersonatedClientset(config *rest.Config, secret map[string]string) (kubernetes.Interface, error) {
+	impersonated, err := ImpersonationConfig(config, secret)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(impersonated)
+}
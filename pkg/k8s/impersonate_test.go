@@ -0,0 +1,74 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestImpersonationConfig(t *testing.T) {
+	config := &rest.Config{Host: "https://cluster.local", BearerToken: "router-token"}
+
+	impersonated, err := ImpersonationConfig(config, map[string]string{
+		"kubernetesUser":   "alice@example.com",
+		"kubernetesGroups": "ops, developers,",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", impersonated.Impersonate.UserName)
+	assert.Equal(t, []string{"ops", "developers"}, impersonated.Impersonate.Groups)
+	assert.Equal(t, "router-token", impersonated.BearerToken)
+	assert.Empty(t, config.Impersonate.UserName, "The router's own config must not change")
+
+	_, err = ImpersonationConfig(config, map[string]string{"kubernetesGroups": "ops"})
+	assert.Error(t, err, "Routes without a user must not fall back to the router's identity")
+}
+
+func TestImpersonationRefusesSystemIdentities(t *testing.T) {
+	config := &rest.Config{Host: "https://cluster.local"}
+	clientset := clientFake.NewSimpleClientset()
+
+	for _, secret := range []map[string]string{
+		{"kubernetesUser": "system:admin"},
+		{"kubernetesUser": "system:serviceaccount:kube-system:default"},
+		{"kubernetesUser": "alice@example.com", "kubernetesGroups": "ops,system:masters"},
+	} {
+		_, err := ImpersonationConfig(config, secret)
+		assert.Error(t, err, "Route %v must not be impersonated", secret)
+		_, err = SessionClientset(clientset, config, secret)
+		assert.Error(t, err)
+		assert.Error(t, CheckPodAccess(clientset, secret, Target{Namespace: "web", Pod: "web-1"}, PodExec))
+	}
+
+	SetImpersonationPrefixes([]string{"oidc:", "team-"})
+	t.Cleanup(func() { SetImpersonationPrefixes(nil) })
+	_, err := ImpersonationConfig(config, map[string]string{"kubernetesUser": "oidc:alice", "kubernetesGroups": "team-web"})
+	assert.NoError(t, err)
+	_, err = ImpersonationConfig(config, map[string]string{"kubernetesUser": "alice"})
+	assert.EqualError(t, err, `user "alice" does not match any impersonation prefix`)
+	_, err = ImpersonationConfig(config, map[string]string{"kubernetesUser": "oidc:alice", "kubernetesGroups": "admins"})
+	assert.EqualError(t, err, `group "admins" does not match any impersonation prefix`)
+}
+
+func TestSessionConfig(t *testing.T) {
+	config := &rest.Config{Host: "https://cluster.local"}
+
+	same, err := SessionConfig(config, map[string]string{"service": "web"})
+	require.NoError(t, err)
+	assert.Same(t, config, same, "Routes without a kubernetesUser keep running as the router")
+
+	impersonated, err := SessionConfig(config, map[string]string{"kubernetesUser": "bob", "kubernetesGroups": "ops"})
+	require.NoError(t, err)
+	assert.Equal(t, rest.ImpersonationConfig{UserName: "bob", Groups: []string{"ops"}}, impersonated.Impersonate)
+
+	clientset := clientFake.NewSimpleClientset()
+	sameClient, err := SessionClientset(clientset, config, map[string]string{})
+	require.NoError(t, err)
+	assert.Same(t, clientset, sameClient)
+
+	userClient, err := SessionClientset(clientset, config, map[string]string{"kubernetesUser": "bob"})
+	require.NoError(t, err)
+	assert.NotSame(t, clientset, userClient)
+}
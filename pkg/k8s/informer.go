@@ -74,14 +74,42 @@ func processSecret(secret *corev1.Secret) {
 	namespace := secret.Namespace
 	username := string(secret.Data["username"])
 	usernameWithNamespace := fmt.Sprintf("%s-%s", namespace, username)
-	secretData := map[string]string{
-		"password":         string(secret.Data["password"]),
-		"publicKey":        string(secret.Data["publicKey"]),
-		"service":          string(secret.Data["service"]),
-		"podLabelSelector": string(secret.Data["podLabelSelector"]),
-		"containerName":    string(secret.Data["containerName"]),
-		"shell":            string(secret.Data["shell"]),
-	}
-	localCache.Set(usernameWithNamespace, secretData, cache.DefaultExpiration)
+	localCache.Set(usernameWithNamespace, secretData(secret), cache.DefaultExpiration)
 	log.Printf("Added/Modified secret: %s, cache size: %d\n", usernameWithNamespace, localCache.ItemCount())
 }
+
+// secretData extracts the route fields the router understands from a user secret.
+// secretNamespace, which confines the route, comes from the Secret's metadata
+// rather than anything its author can write.
+func secretData(secret *corev1.Secret) map[string]string {
+	return map[string]string{
+		"password":           string(secret.Data["password"]),
+		"publicKey":          string(secret.Data["publicKey"]),
+		"service":            string(secret.Data["service"]),
+		"podLabelSelector":   string(secret.Data["podLabelSelector"]),
+		"containerName":      string(secret.Data["containerName"]),
+		"shell":              string(secret.Data["shell"]),
+		"allowedPorts":       string(secret.Data["allowedPorts"]),
+		"allowedRemotePorts": string(secret.Data["allowedRemotePorts"]),
+		"keepaliveInterval":  string(secret.Data["keepaliveInterval"]),
+		"idleTimeout":        string(secret.Data["idleTimeout"]),
+		"maxSessionDuration": string(secret.Data["maxSessionDuration"]),
+		"sftpRoots":          string(secret.Data["sftpRoots"]),
+		"sftpReadOnly":       string(secret.Data["sftpReadOnly"]),
+		"pvc":                string(secret.Data["pvc"]),
+		"sftpMode":           string(secret.Data["sftpMode"]),
+		"configNamespaces":   string(secret.Data["configNamespaces"]),
+		"kubernetesUser":     string(secret.Data["kubernetesUser"]),
+		"kubernetesGroups":   string(secret.Data["kubernetesGroups"]),
+		"allowCommands":      string(secret.Data["allowCommands"]),
+		"denyCommands":       string(secret.Data["denyCommands"]),
+		"forceCommand":       string(secret.Data["forceCommand"]),
+		"requireApproval":    string(secret.Data["requireApproval"]),
+		"approvalTTL":        string(secret.Data["approvalTTL"]),
+		"approvalTimeout":    string(secret.Data["approvalTimeout"]),
+		"schedule":           string(secret.Data["schedule"]),
+		"timezone":           string(secret.Data["timezone"]),
+		"maxSessions":        string(secret.Data["maxSessions"]),
+		"secretNamespace":    secret.Namespace,
+	}
+}
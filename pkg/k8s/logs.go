@@ -0,0 +1,60 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// LogFile is a container log the user's route can read. Previous is the log
+// of the container's last terminated instance.
+type LogFile struct {
+	Target
+	Previous bool
+	ModTime  time.Time
+}
+
+// ResolveLogs returns the logs of every container the user's route covers,
+// including those of pods that have already terminated. Pods the route may
+// not reach are left out.
+func ResolveLogs(clientset kubernetes.Interface, secret map[string]string) ([]LogFile, error) {
+	pods, err := clientset.CoreV1().Pods(secret["service"]).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: secret["podLabelSelector"],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	var logs []LogFile
+	for _, pod := range allowedPods(secret, pods.Items) {
+		for _, status := range pod.Status.ContainerStatuses {
+			if container := secret["containerName"]; container != "" && status.Name != container {
+				continue
+			}
+			target := Target{Namespace: pod.Namespace, Pod: pod.Name, Container: status.Name}
+			switch {
+			case status.State.Running != nil:
+				logs = append(logs, LogFile{Target: target, ModTime: status.State.Running.StartedAt.Time})
+			case status.State.Terminated != nil:
+				logs = append(logs, LogFile{Target: target, ModTime: status.State.Terminated.FinishedAt.Time})
+			}
+			if last := status.LastTerminationState.Terminated; last != nil {
+				logs = append(logs, LogFile{Target: target, Previous: true, ModTime: last.FinishedAt.Time})
+			}
+		}
+	}
+	return logs, nil
+}
+
+// ReadLog reads a container's log from the start, at most limit bytes of it.
+func ReadLog(clientset kubernetes.Interface, log LogFile, limit int64) ([]byte, error) {
+	return clientset.CoreV1().Pods(log.Namespace).GetLogs(log.Pod, &corev1.PodLogOptions{
+		Container:  log.Container,
+		Previous:   log.Previous,
+		LimitBytes: &limit,
+	}).DoRaw(context.TODO())
+}
@@ -0,0 +1,59 @@
+package k8s
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestResolveLogs(t *testing.T) {
+	running := testPod("web-1", corev1.PodRunning, "app", "sidecar")
+	running.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{
+			Name:  "app",
+			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			LastTerminationState: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: 137},
+			},
+		},
+		{Name: "sidecar", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+	}
+	finished := testPod("job-1", corev1.PodSucceeded, "app")
+	finished.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "app", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+	}
+	waiting := testPod("web-2", corev1.PodPending, "app")
+	waiting.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "app", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{}}},
+	}
+	clientset := clientFake.NewSimpleClientset(running, finished, waiting)
+
+	logs, err := ResolveLogs(clientset, map[string]string{"service": "web", "secretNamespace": "web", "podLabelSelector": "app=web", "containerName": "app"})
+	require.NoError(t, err)
+	var names []string
+	for _, log := range logs {
+		names = append(names, log.Pod+"/"+log.Container+map[bool]string{true: " (previous)"}[log.Previous])
+	}
+	assert.ElementsMatch(t, []string{"web-1/app", "web-1/app (previous)", "job-1/app"}, names,
+		"Containers that never started have no log")
+
+	data, err := ReadLog(clientset, logs[0], 1<<20)
+	require.NoError(t, err)
+	assert.NotEmpty(t, data)
+}
+
+func TestResolveLogsListError(t *testing.T) {
+	clientset := clientFake.NewSimpleClientset()
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	logs, err := ResolveLogs(clientset, map[string]string{"service": "web"})
+	assert.Error(t, err)
+	assert.Empty(t, logs)
+}
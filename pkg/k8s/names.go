@@ -0,0 +1,14 @@
+package k8s
+
+import (
+	"regexp"
+	"strings"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// sanitizeName lowercases s and replaces what DNS labels do not allow with
+// dashes, so a login can be used in object names and label values.
+func sanitizeName(s string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
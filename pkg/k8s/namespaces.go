@@ -0,0 +1,104 @@
+package k8s
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// allowedNamespacesAnnotation on a pod lists the namespaces whose routes may
+// reach it besides its own, or "*" for any:
+//
+//	kubectl annotate pod <name> ssh-router/allowed-namespaces=team-a,team-b
+const allowedNamespacesAnnotation = "ssh-router/allowed-namespaces"
+
+// NamespacePolicy lists, by the namespace of a user Secret, the other
+// namespaces its routes may target. "*" stands for any namespace on either
+// side.
+type NamespacePolicy map[string][]string
+
+// ParseNamespacePolicy parses rules of the form source=target.
+func ParseNamespacePolicy(rules []string) (NamespacePolicy, error) {
+	policy := NamespacePolicy{}
+	for _, rule := range rules {
+		source, target, ok := strings.Cut(rule, "=")
+		source, target = strings.TrimSpace(source), strings.TrimSpace(target)
+		if !ok || source == "" || target == "" {
+			return nil, fmt.Errorf("invalid cross-namespace rule %q, expected source=target", rule)
+		}
+		policy[source] = append(policy[source], target)
+	}
+	return policy, nil
+}
+
+func (p NamespacePolicy) allows(source, target string) bool {
+	for _, key := range []string{source, "*"} {
+		for _, allowed := range p[key] {
+			if allowed == target || allowed == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	namespacePolicyMu sync.RWMutex
+	namespacePolicy   = NamespacePolicy{}
+)
+
+// SetNamespacePolicy replaces the cross-namespace policy. Without one, routes
+// only reach their Secret's own namespace and pods that opt in.
+func SetNamespacePolicy(policy NamespacePolicy) {
+	namespacePolicyMu.Lock()
+	defer namespacePolicyMu.Unlock()
+	namespacePolicy = policy
+}
+
+// CheckNamespace returns an error unless the route may create or use objects
+// in namespace: its Secret's own namespace or one the policy allows. Routes
+// that do not know their Secret's namespace are confined to nothing.
+func CheckNamespace(secret map[string]string, namespace string) error {
+	source := secret["secretNamespace"]
+	if source != "" && source == namespace {
+		return nil
+	}
+	namespacePolicyMu.RLock()
+	defer namespacePolicyMu.RUnlock()
+	if source != "" && namespacePolicy.allows(source, namespace) {
+		return nil
+	}
+	return fmt.Errorf("routes from namespace %q may not reach namespace %q", source, namespace)
+}
+
+// podAllowed reports whether the route may reach pod, either through
+// CheckNamespace or because the pod lists the route's namespace in its
+// allowed namespaces annotation.
+func podAllowed(secret map[string]string, pod corev1.Pod) bool {
+	if CheckNamespace(secret, pod.Namespace) == nil {
+		return true
+	}
+	source := secret["secretNamespace"]
+	if source == "" {
+		return false
+	}
+	for _, allowed := range strings.Split(pod.Annotations[allowedNamespacesAnnotation], ",") {
+		if allowed = strings.TrimSpace(allowed); allowed == source || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedPods drops the pods the route may not reach.
+func allowedPods(secret map[string]string, pods []corev1.Pod) []corev1.Pod {
+	var allowed []corev1.Pod
+	for _, pod := range pods {
+		if podAllowed(secret, pod) {
+			allowed = append(allowed, pod)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,71 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseNamespacePolicy(t *testing.T) {
+	policy, err := ParseNamespacePolicy([]string{"team-a=shared", "team-a=tools", "ops=*", "*=public"})
+	require.NoError(t, err)
+	assert.Equal(t, NamespacePolicy{"team-a": {"shared", "tools"}, "ops": {"*"}, "*": {"public"}}, policy)
+
+	for _, rule := range []string{"team-a", "=shared", "team-a="} {
+		_, err := ParseNamespacePolicy([]string{rule})
+		assert.Error(t, err, "Rule %q is invalid", rule)
+	}
+}
+
+func TestCheckNamespace(t *testing.T) {
+	policy, err := ParseNamespacePolicy([]string{"team-a=shared", "ops=*", "*=public"})
+	require.NoError(t, err)
+	SetNamespacePolicy(policy)
+	t.Cleanup(func() { SetNamespacePolicy(NamespacePolicy{}) })
+
+	teamA := map[string]string{"secretNamespace": "team-a"}
+	assert.NoError(t, CheckNamespace(teamA, "team-a"))
+	assert.NoError(t, CheckNamespace(teamA, "shared"))
+	assert.NoError(t, CheckNamespace(teamA, "public"))
+	assert.EqualError(t, CheckNamespace(teamA, "team-b"), `routes from namespace "team-a" may not reach namespace "team-b"`)
+	assert.NoError(t, CheckNamespace(map[string]string{"secretNamespace": "ops"}, "kube-system"))
+	assert.Error(t, CheckNamespace(map[string]string{}, "public"), "Routes without a Secret namespace reach nothing")
+	assert.Error(t, CheckNamespace(map[string]string{}, ""))
+}
+
+func TestResolveTargetsAcrossNamespaces(t *testing.T) {
+	optedIn := testPod("web-1", corev1.PodRunning, "app")
+	optedIn.Annotations = map[string]string{allowedNamespacesAnnotation: "team-b, team-a"}
+	anyone := testPod("web-2", corev1.PodRunning, "app")
+	anyone.Annotations = map[string]string{allowedNamespacesAnnotation: "*"}
+	closed := testPod("web-3", corev1.PodRunning, "app")
+	clientset := clientFake.NewSimpleClientset(optedIn, anyone, closed)
+
+	route := map[string]string{"service": "web", "secretNamespace": "team-a", "podLabelSelector": "app=web"}
+	targets, err := ResolveTargets(clientset, route)
+	require.NoError(t, err)
+	assert.Equal(t, []Target{
+		{Namespace: "web", Pod: "web-1", Container: "app"},
+		{Namespace: "web", Pod: "web-2", Container: "app"},
+	}, targets, "Only pods that opt in are reachable")
+
+	route["secretNamespace"] = "team-c"
+	target, err := ResolveTarget(clientset, route)
+	require.NoError(t, err)
+	assert.Equal(t, "web-2", target.Pod)
+
+	clientset = clientFake.NewSimpleClientset(closed)
+	_, err = ResolveTarget(clientset, route)
+	assert.EqualError(t, err, `routes from namespace "team-c" may not reach namespace "web"`)
+	_, err = ResolveTargets(clientset, route)
+	assert.Error(t, err)
+
+	SetNamespacePolicy(NamespacePolicy{"team-c": {"web"}})
+	t.Cleanup(func() { SetNamespacePolicy(NamespacePolicy{}) })
+	target, err = ResolveTarget(clientset, route)
+	require.NoError(t, err)
+	assert.Equal(t, "web-3", target.Pod, "The policy allows every pod in the namespace")
+}
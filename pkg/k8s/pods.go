@@ -0,0 +1,75 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Target identifies the pod and container a user's session is routed to.
+type Target struct {
+	Namespace string
+	Pod       string
+	Container string
+}
+
+// ResolveTarget picks the pod matched by the user's route, among those
+// outside its Secret's namespace only the ones the route may reach.
+func ResolveTarget(clientset kubernetes.Interface, secret map[string]string) (Target, error) {
+	pods, err := clientset.CoreV1().Pods(secret["service"]).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: secret["podLabelSelector"],
+	})
+	if err != nil || len(pods.Items) == 0 {
+		return Target{}, fmt.Errorf("failed to list pods: %v", err)
+	}
+	allowed := allowedPods(secret, pods.Items)
+	if len(allowed) == 0 {
+		return Target{}, CheckNamespace(secret, pods.Items[0].Namespace)
+	}
+	pod := allowed[0]
+
+	return Target{
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+		Container: secret["containerName"],
+	}, nil
+}
+
+// ResolveTargets returns every container the user's route can reach: the
+// route's container in each matched pod, or all of a pod's containers when the
+// route names none. Pods that have terminated or that the route may not reach
+// are skipped.
+func ResolveTargets(clientset kubernetes.Interface, secret map[string]string) ([]Target, error) {
+	pods, err := clientset.CoreV1().Pods(secret["service"]).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: secret["podLabelSelector"],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	allowed := allowedPods(secret, pods.Items)
+	if len(allowed) == 0 && len(pods.Items) > 0 {
+		return nil, CheckNamespace(secret, pods.Items[0].Namespace)
+	}
+
+	var targets []Target
+	for _, pod := range allowed {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		if container := secret["containerName"]; container != "" {
+			targets = append(targets, Target{Namespace: pod.Namespace, Pod: pod.Name, Container: container})
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			targets = append(targets, Target{Namespace: pod.Namespace, Pod: pod.Name, Container: container.Name})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("failed to list pods: no running pods match %q", secret["podLabelSelector"])
+	}
+	return targets, nil
+}
@@ -0,0 +1,53 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func testPod(name string, phase corev1.PodPhase, containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "web",
+			Labels:    map[string]string{"app": "web"},
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+	for _, container := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: container})
+	}
+	return pod
+}
+
+func TestResolveTargets(t *testing.T) {
+	clientset := clientFake.NewSimpleClientset(
+		testPod("web-1", corev1.PodRunning, "app", "sidecar"),
+		testPod("web-2", corev1.PodRunning, "app", "sidecar"),
+		testPod("web-old", corev1.PodSucceeded, "app"),
+	)
+
+	targets, err := ResolveTargets(clientset, map[string]string{"service": "web", "secretNamespace": "web", "podLabelSelector": "app=web"})
+	require.NoError(t, err)
+	assert.Equal(t, []Target{
+		{Namespace: "web", Pod: "web-1", Container: "app"},
+		{Namespace: "web", Pod: "web-1", Container: "sidecar"},
+		{Namespace: "web", Pod: "web-2", Container: "app"},
+		{Namespace: "web", Pod: "web-2", Container: "sidecar"},
+	}, targets)
+
+	targets, err = ResolveTargets(clientset, map[string]string{"service": "web", "secretNamespace": "web", "podLabelSelector": "app=web", "containerName": "app"})
+	require.NoError(t, err)
+	assert.Equal(t, []Target{
+		{Namespace: "web", Pod: "web-1", Container: "app"},
+		{Namespace: "web", Pod: "web-2", Container: "app"},
+	}, targets)
+
+	_, err = ResolveTargets(clientset, map[string]string{"service": "web", "secretNamespace": "web", "podLabelSelector": "app=api"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,185 @@
+package k8s
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// CheckPortForward returns an error unless the user's route lists port in allowedPorts.
+func CheckPortForward(username string, port uint32) error {
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return err
+	}
+	allowed, err := portAllowed(secret["allowedPorts"], port)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("forwarding to port %d is not allowed", port)
+	}
+	return nil
+}
+
+// portAllowed reports whether port is covered by a comma separated list of
+// ports and ranges, e.g. "5432,8000-8080".
+func portAllowed(allowedPorts string, port uint32) (bool, error) {
+	for _, entry := range strings.Split(allowedPorts, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			high = low
+		}
+		first, err := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+		if err != nil {
+			return false, fmt.Errorf("invalid allowedPorts entry %q: %v", entry, err)
+		}
+		last, err := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+		if err != nil {
+			return false, fmt.Errorf("invalid allowedPorts entry %q: %v", entry, err)
+		}
+		if uint64(port) >= first && uint64(port) <= last {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// PortForwardInPod tunnels conn to port on the user's target pod through the
+// pods/portforward subresource. A nil dialer builds an SPDY dialer from config.
+func PortForwardInPod(clientset kubernetes.Interface, restClient rest.Interface, dialer httpstream.Dialer, config *rest.Config, username string, port uint32, conn io.ReadWriter) error {
+	secret, target, err := PortForwardTarget(clientset, username, port)
+	if err != nil {
+		return err
+	}
+	return PortForwardToTarget(restClient, dialer, config, secret, target, port, conn)
+}
+
+// PortForwardTarget checks that the user's route allows port and resolves the
+// pod it forwards to, reviewing the route's access to that pod.
+func PortForwardTarget(clientset kubernetes.Interface, username string, port uint32) (map[string]string, Target, error) {
+	if err := CheckPortForward(username, port); err != nil {
+		return nil, Target{}, err
+	}
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return nil, Target{}, err
+	}
+	target, err := ResolveTarget(clientset, secret)
+	if err != nil {
+		return nil, Target{}, err
+	}
+	if err := CheckPodAccess(clientset, secret, target, PodPortForward); err != nil {
+		return nil, Target{}, err
+	}
+	return secret, target, nil
+}
+
+// PortForwardToTarget tunnels conn to port on a target PortForwardTarget
+// resolved for the route in secret.
+func PortForwardToTarget(restClient rest.Interface, dialer httpstream.Dialer, config *rest.Config, secret map[string]string, target Target, port uint32, conn io.ReadWriter) error {
+	config, err := SessionConfig(config, secret)
+	if err != nil {
+		return err
+	}
+
+	if dialer == nil {
+		req := restClient.
+			Post().
+			Resource("pods").
+			Name(target.Pod).
+			Namespace(target.Namespace).
+			SubResource("portforward")
+
+		transport, upgrader, err := spdy.RoundTripperFor(config)
+		if err != nil {
+			return fmt.Errorf("failed to create port-forward transport: %v", err)
+		}
+		dialer = spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	}
+
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return fmt.Errorf("failed to dial pod %s/%s: %v", target.Namespace, target.Pod, err)
+	}
+	defer streamConn.Close()
+
+	log.Printf("Forwarding connection to %s/%s:%d", target.Namespace, target.Pod, port)
+	return forwardPort(streamConn, port, conn)
+}
+
+// forwardPort copies data between conn and a single port-forward stream pair,
+// mirroring what kubectl port-forward does per accepted connection.
+func forwardPort(streamConn httpstream.Connection, port uint32, conn io.ReadWriter) error {
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.FormatUint(uint64(port), 10))
+	headers.Set(corev1.PortForwardRequestIDHeader, "0")
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("error creating error stream for port %d: %v", port, err)
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+	defer streamConn.RemoveStreams(errorStream)
+
+	errorChan := make(chan error, 1)
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errorChan <- fmt.Errorf("error reading from error stream for port %d: %v", port, err)
+		case len(message) > 0:
+			errorChan <- fmt.Errorf("an error occurred forwarding port %d: %s", port, string(message))
+		}
+		close(errorChan)
+	}()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("error creating forwarding stream for port %d: %v", port, err)
+	}
+	defer streamConn.RemoveStreams(dataStream)
+
+	localError := make(chan error, 1)
+	remoteDone := make(chan struct{})
+
+	go func() {
+		// Copy from the pod back to the SSH client.
+		if _, err := io.Copy(conn, dataStream); err != nil {
+			log.Printf("Error copying from pod port %d: %v", port, err)
+		}
+		close(remoteDone)
+	}()
+
+	go func() {
+		// Tell the pod we're not sending any more data once the client is done.
+		defer dataStream.Close()
+		if _, err := io.Copy(dataStream, conn); err != nil {
+			localError <- err
+		}
+	}()
+
+	select {
+	case <-remoteDone:
+	case err := <-localError:
+		return fmt.Errorf("error copying to pod port %d: %v", port, err)
+	}
+
+	return <-errorChan
+}
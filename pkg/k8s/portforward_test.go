@@ -0,0 +1,157 @@
+package k8s
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/rest/fake"
+)
+
+// fakeStream only answers reads once its write side has been closed, so the
+// client->pod copy is complete before the pod->client copy finishes.
+type fakeStream struct {
+	reader  io.Reader
+	written bytes.Buffer
+	headers http.Header
+	closed  chan struct{}
+}
+
+func (s *fakeStream) Read(p []byte) (int, error) {
+	<-s.closed
+	return s.reader.Read(p)
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) { return s.written.Write(p) }
+
+func (s *fakeStream) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func (s *fakeStream) Reset() error         { return nil }
+func (s *fakeStream) Headers() http.Header { return s.headers }
+func (s *fakeStream) Identifier() uint32   { return 0 }
+
+type fakeStreamConn struct {
+	streams   []*fakeStream
+	errorData string
+	podData   string
+}
+
+func (c *fakeStreamConn) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	data := c.podData
+	if headers.Get(corev1.StreamType) == corev1.StreamTypeError {
+		data = c.errorData
+	}
+	stream := &fakeStream{reader: strings.NewReader(data), headers: headers.Clone(), closed: make(chan struct{})}
+	c.streams = append(c.streams, stream)
+	return stream, nil
+}
+
+func (c *fakeStreamConn) Close() error                               { return nil }
+func (c *fakeStreamConn) CloseChan() <-chan bool                     { return make(chan bool) }
+func (c *fakeStreamConn) SetIdleTimeout(timeout time.Duration)       {}
+func (c *fakeStreamConn) RemoveStreams(streams ...httpstream.Stream) {}
+
+type fakeDialer struct {
+	conn      *fakeStreamConn
+	protocols []string
+}
+
+func (d *fakeDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	d.protocols = protocols
+	return d.conn, protocols[0], nil
+}
+
+type clientConn struct {
+	reader  io.Reader
+	written bytes.Buffer
+}
+
+func (c *clientConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
+func (c *clientConn) Write(p []byte) (int, error) { return c.written.Write(p) }
+
+func TestPortAllowed(t *testing.T) {
+	tests := []struct {
+		allowed string
+		port    uint32
+		want    bool
+	}{
+		{"", 5432, false},
+		{"5432", 5432, true},
+		{"5432", 5433, false},
+		{"22, 8000-8080", 8080, true},
+		{"22, 8000-8080", 8081, false},
+	}
+	for _, tt := range tests {
+		got, err := portAllowed(tt.allowed, tt.port)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, got, "allowedPorts %q port %d", tt.allowed, tt.port)
+	}
+
+	_, err := portAllowed("http", 80)
+	assert.Error(t, err, "Non-numeric entries should be rejected")
+}
+
+func TestPortForwardInPod(t *testing.T) {
+	localCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+	initTestCache()
+	secret, _ := GetUserSecret("default-testuser")
+	secret["allowedPorts"] = "5432"
+
+	clientset := clientFake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "default",
+			Labels: map[string]string{
+				"testpodlabelselector": "true",
+			},
+		},
+	})
+	restClient := &fake.RESTClient{}
+	config := &rest.Config{Host: "http://localhost"}
+
+	t.Run("allowed port", func(t *testing.T) {
+		dialer := &fakeDialer{conn: &fakeStreamConn{podData: "pong"}}
+		conn := &clientConn{reader: strings.NewReader("ping")}
+
+		err := PortForwardInPod(clientset, restClient, dialer, config, "default-testuser", 5432, conn)
+		require.NoError(t, err)
+
+		require.Len(t, dialer.conn.streams, 2)
+		assert.Equal(t, corev1.StreamTypeError, dialer.conn.streams[0].headers.Get(corev1.StreamType))
+		assert.Equal(t, corev1.StreamTypeData, dialer.conn.streams[1].headers.Get(corev1.StreamType))
+		assert.Equal(t, "5432", dialer.conn.streams[1].headers.Get(corev1.PortHeader))
+		assert.Equal(t, "ping", dialer.conn.streams[1].written.String(), "Client data should reach the pod")
+		assert.Equal(t, "pong", conn.written.String(), "Pod data should reach the client")
+	})
+
+	t.Run("pod reports error", func(t *testing.T) {
+		dialer := &fakeDialer{conn: &fakeStreamConn{errorData: "connection refused"}}
+		conn := &clientConn{reader: strings.NewReader("")}
+
+		err := PortForwardInPod(clientset, restClient, dialer, config, "default-testuser", 5432, conn)
+		assert.ErrorContains(t, err, "connection refused")
+	})
+
+	t.Run("disallowed port", func(t *testing.T) {
+		dialer := &fakeDialer{conn: &fakeStreamConn{}}
+		conn := &clientConn{reader: strings.NewReader("")}
+
+		err := PortForwardInPod(clientset, restClient, dialer, config, "default-testuser", 22, conn)
+		assert.Error(t, err)
+		assert.Nil(t, dialer.protocols, "Disallowed ports should never be dialed")
+	})
+}
@@ -34,15 +34,7 @@ func reconcileCache(clientset kubernetes.Interface, namespace string) {
 		namespace := secret.Namespace
 		username := string(secret.Data["username"])
 		usernameWithNamespace := fmt.Sprintf("%s-%s", namespace, username)
-		secretData := map[string]string{
-			"password":         string(secret.Data["password"]),
-			"publicKey":        string(secret.Data["publicKey"]),
-			"service":          string(secret.Data["service"]),
-			"podLabelSelector": string(secret.Data["podLabelSelector"]),
-			"containerName":    string(secret.Data["containerName"]),
-			"shell":            string(secret.Data["shell"]),
-		}
-		SetSecretInCache(usernameWithNamespace, secretData)
+		SetSecretInCache(usernameWithNamespace, secretData(&secret))
 		currentSecrets[usernameWithNamespace] = true
 	}
 
@@ -37,12 +37,34 @@ func TestReconcileCache(t *testing.T) {
 	cachedSecret, found := GetSecretFromCache(usernameWithNamespace)
 	assert.True(t, found, "Secret should be found in cache after reconciliation")
 	expectedData := map[string]string{
-		"password":         "testpassword",
-		"publicKey":        "",
-		"service":          "",
-		"podLabelSelector": "",
-		"containerName":    "",
-		"shell":            "",
+		"password":           "testpassword",
+		"publicKey":          "",
+		"service":            "",
+		"podLabelSelector":   "",
+		"containerName":      "",
+		"shell":              "",
+		"allowedPorts":       "",
+		"allowedRemotePorts": "",
+		"keepaliveInterval":  "",
+		"idleTimeout":        "",
+		"maxSessionDuration": "",
+		"sftpRoots":          "",
+		"sftpReadOnly":       "",
+		"pvc":                "",
+		"sftpMode":           "",
+		"configNamespaces":   "",
+		"kubernetesUser":     "",
+		"kubernetesGroups":   "",
+		"allowCommands":      "",
+		"denyCommands":       "",
+		"forceCommand":       "",
+		"requireApproval":    "",
+		"approvalTTL":        "",
+		"approvalTimeout":    "",
+		"schedule":           "",
+		"timezone":           "",
+		"maxSessions":        "",
+		"secretNamespace":    "default",
 	}
 	assert.Equal(t, expectedData, cachedSecret, "Secret data should match")
 
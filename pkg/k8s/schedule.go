@@ -0,0 +1,318 @@
+package k8s
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Schedules name IANA time zones, which the router image may not ship
+	_ "time/tzdata"
+)
+
+// maxScheduleHorizon bounds how far ahead the close of a window is looked
+// for; windows that are still open by then never close.
+const maxScheduleHorizon = 8 * 24 * time.Hour
+
+// Schedule is a set of access windows in a time zone. Each window is either
+// days and a time range, e.g. "Mon-Fri 09:00-17:30" or "Sat,Sun 22:00-06:00",
+// or a cron expression and a duration, e.g. "0 9 * * 1-5 8h".
+type Schedule struct {
+	location *time.Location
+	windows  []window
+}
+
+// window is a recurring span of time; end returns when the span containing t
+// closes.
+type window interface {
+	contains(t time.Time) bool
+	end(t time.Time) time.Time
+}
+
+// CheckSchedule returns an error if the user's route has a schedule that is
+// closed at now, and otherwise when the current window closes. The zero time
+// means the route is not limited.
+func CheckSchedule(username string, now time.Time) (time.Time, error) {
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if strings.TrimSpace(secret["schedule"]) == "" {
+		return time.Time{}, nil
+	}
+	schedule, err := ParseSchedule(secret["schedule"], secret["timezone"])
+	if err != nil {
+		return time.Time{}, err
+	}
+	open, closes := schedule.Open(now)
+	if !open {
+		return time.Time{}, fmt.Errorf("login outside the access schedule")
+	}
+	return closes, nil
+}
+
+// ParseSchedule parses windows separated by ";" or newlines. An empty
+// timezone means UTC.
+func ParseSchedule(spec, timezone string) (*Schedule, error) {
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+	}
+
+	schedule := &Schedule{location: location}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		fields := strings.Fields(entry)
+		var w window
+		var err error
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+			w, err = parseDayWindow(fields[0], fields[1])
+		case 6:
+			w, err = parseCronWindow(fields[:5], fields[5])
+		default:
+			err = fmt.Errorf("expected days and a time range or a cron expression and a duration")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule entry %q: %v", strings.TrimSpace(entry), err)
+		}
+		schedule.windows = append(schedule.windows, w)
+	}
+	if len(schedule.windows) == 0 {
+		return nil, fmt.Errorf("schedule %q has no windows", spec)
+	}
+	return schedule, nil
+}
+
+// Open reports whether t falls within a window and, if so, when the windows
+// covering t close. Adjoining windows are merged; a zero close means the
+// schedule stays open for the foreseeable future.
+func (s *Schedule) Open(t time.Time) (bool, time.Time) {
+	t = t.In(s.location)
+	open := false
+	for _, w := range s.windows {
+		open = open || w.contains(t)
+	}
+	if !open {
+		return false, time.Time{}
+	}
+
+	closes := t
+	for extended := true; extended; {
+		extended = false
+		for _, w := range s.windows {
+			if !w.contains(closes) {
+				continue
+			}
+			if end := w.end(closes); end.After(closes) {
+				closes, extended = end, true
+			}
+		}
+		if closes.Sub(t) > maxScheduleHorizon {
+			return true, time.Time{}
+		}
+	}
+	return true, closes
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// dayWindow opens on the given days from opens to closes, both offsets from
+// midnight. Windows ending before they start run past midnight.
+type dayWindow struct {
+	days          [7]bool
+	opens, closes time.Duration
+}
+
+func parseDayWindow(days, times string) (*dayWindow, error) {
+	w := &dayWindow{}
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return nil, fmt.Errorf("unknown day %q", last)
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return nil, fmt.Errorf("time range %q must look like 09:00-17:00", times)
+	}
+	var err error
+	if w.opens, err = parseClock(start); err != nil {
+		return nil, err
+	}
+	if w.closes, err = parseClock(end); err != nil {
+		return nil, err
+	}
+	if w.opens == w.closes {
+		return nil, fmt.Errorf("time range %q is empty", times)
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM, allowing 24:00 as the end of the day.
+func parseClock(value string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// clock returns the wall clock time of t as an offset from midnight.
+func clock(t time.Time) time.Duration {
+	hour, minute, second := t.Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+}
+
+// at returns the instant the wall clock shows offset on the day of t.
+func at(t time.Time, offset time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, t.Location())
+}
+
+func (w *dayWindow) contains(t time.Time) bool {
+	offset := clock(t)
+	if w.opens < w.closes {
+		return w.days[t.Weekday()] && offset >= w.opens && offset < w.closes
+	}
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && offset >= w.opens) || (w.days[yesterday] && offset < w.closes)
+}
+
+func (w *dayWindow) end(t time.Time) time.Time {
+	if w.opens > w.closes && clock(t) >= w.opens {
+		return at(t.AddDate(0, 0, 1), w.closes)
+	}
+	return at(t, w.closes)
+}
+
+// cronWindow opens at every minute matching a cron expression and stays open
+// for a duration.
+type cronWindow struct {
+	minutes, hours, days, months, weekdays []bool
+	anyDay, anyWeekday                     bool
+	duration                               time.Duration
+}
+
+func parseCronWindow(fields []string, duration string) (*cronWindow, error) {
+	w := &cronWindow{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	var err error
+	if w.duration, err = time.ParseDuration(duration); err != nil || w.duration < time.Minute {
+		return nil, fmt.Errorf("invalid duration %q", duration)
+	}
+	if w.duration > maxScheduleHorizon {
+		return nil, fmt.Errorf("duration %q is longer than %s", duration, maxScheduleHorizon)
+	}
+	for i, field := range []struct {
+		set      *[]bool
+		min, max int
+	}{{&w.minutes, 0, 59}, {&w.hours, 0, 23}, {&w.days, 1, 31}, {&w.months, 1, 12}, {&w.weekdays, 0, 7}} {
+		if *field.set, err = parseCronField(fields[i], field.min, field.max); err != nil {
+			return nil, err
+		}
+	}
+	// 7 is Sunday too
+	w.weekdays[0] = w.weekdays[0] || w.weekdays[7]
+	return w, nil
+}
+
+// parseCronField parses a comma separated list of *, values and ranges,
+// each optionally with a /step.
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		span, stepValue, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepValue); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid cron step %q", part)
+			}
+		}
+
+		low, high := min, max
+		if span != "*" {
+			first, last, isRange := strings.Cut(span, "-")
+			var err error
+			if low, err = strconv.Atoi(first); err != nil {
+				return nil, fmt.Errorf("invalid cron field %q", field)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(last); err != nil {
+					return nil, fmt.Errorf("invalid cron field %q", field)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("cron field %q is out of range %d-%d", field, min, max)
+		}
+		for value := low; value <= high; value += step {
+			set[value] = true
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether a window starts at the minute of t. As in cron,
+// a restricted day of month and day of week match if either does.
+func (w *cronWindow) matches(t time.Time) bool {
+	if !w.minutes[t.Minute()] || !w.hours[t.Hour()] || !w.months[t.Month()] {
+		return false
+	}
+	day, weekday := w.days[t.Day()], w.weekdays[t.Weekday()]
+	switch {
+	case w.anyDay && w.anyWeekday:
+		return true
+	case w.anyDay:
+		return weekday
+	case w.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// latestStart returns the latest start of a window open at t.
+func (w *cronWindow) latestStart(t time.Time) (time.Time, bool) {
+	minute := t.Truncate(time.Minute)
+	for start := minute; t.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.matches(start) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (w *cronWindow) contains(t time.Time) bool {
+	_, ok := w.latestStart(t)
+	return ok
+}
+
+func (w *cronWindow) end(t time.Time) time.Time {
+	start, _ := w.latestStart(t)
+	return start.Add(w.duration)
+}
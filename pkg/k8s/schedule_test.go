@@ -0,0 +1,130 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// monday is 2024-03-04, a Monday, at the given wall clock time in UTC.
+func monday(hour, minute int) time.Time {
+	return time.Date(2024, 3, 4, hour, minute, 0, 0, time.UTC)
+}
+
+func TestScheduleDayWindows(t *testing.T) {
+	schedule, err := ParseSchedule("Mon-Fri 09:00-17:30; Sat,Sun 22:00-06:00", "")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		at     time.Time
+		open   bool
+		closes time.Time
+	}{
+		{monday(8, 59), false, time.Time{}},
+		{monday(9, 0), true, monday(17, 30)},
+		{monday(17, 29), true, monday(17, 30)},
+		{monday(17, 30), false, time.Time{}},
+		// Sunday night runs into Monday morning
+		{monday(5, 0), true, monday(6, 0)},
+		{monday(6, 0), false, time.Time{}},
+		// Saturday 23:00 is open until Sunday 06:00, Sunday 22:00 opens again
+		{monday(23, 0).AddDate(0, 0, 5), true, monday(6, 0).AddDate(0, 0, 6)},
+		{monday(12, 0).AddDate(0, 0, 6), false, time.Time{}},
+	} {
+		open, closes := schedule.Open(test.at)
+		assert.Equal(t, test.open, open, "%s", test.at)
+		assert.True(t, test.closes.Equal(closes), "%s closes at %s, want %s", test.at, closes, test.closes)
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+	schedule, err := ParseSchedule("Mon-Fri 09:00-17:00", "America/New_York")
+	require.NoError(t, err)
+
+	// 09:00 in New York is 14:00 UTC in March before DST starts
+	open, _ := schedule.Open(monday(13, 59))
+	assert.False(t, open)
+	open, closes := schedule.Open(monday(14, 0))
+	assert.True(t, open)
+	assert.True(t, monday(22, 0).Equal(closes), "closes at %s", closes)
+
+	_, err = ParseSchedule("Mon-Fri 09:00-17:00", "Mars/Olympus_Mons")
+	assert.Error(t, err)
+}
+
+func TestScheduleCronWindows(t *testing.T) {
+	schedule, err := ParseSchedule("0 9 * * 1-5 8h30m\n*/15 * 1 * * 5m", "")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		at     time.Time
+		open   bool
+		closes time.Time
+	}{
+		{monday(8, 59), false, time.Time{}},
+		{monday(9, 0), true, monday(17, 30)},
+		{monday(17, 29), true, monday(17, 30)},
+		{monday(17, 30), false, time.Time{}},
+		// Saturday is outside 1-5
+		{monday(10, 0).AddDate(0, 0, 5), false, time.Time{}},
+		// The first of the month opens for five minutes every quarter hour
+		{time.Date(2024, 6, 1, 3, 47, 0, 0, time.UTC), true, time.Date(2024, 6, 1, 3, 50, 0, 0, time.UTC)},
+		{time.Date(2024, 6, 1, 3, 50, 0, 0, time.UTC), false, time.Time{}},
+	} {
+		open, closes := schedule.Open(test.at)
+		assert.Equal(t, test.open, open, "%s", test.at)
+		assert.True(t, test.closes.Equal(closes), "%s closes at %s, want %s", test.at, closes, test.closes)
+	}
+}
+
+func TestScheduleMergesAdjoiningWindows(t *testing.T) {
+	schedule, err := ParseSchedule("Mon 09:00-12:00; Mon 12:00-18:00; 0 18 * * 1 2h", "")
+	require.NoError(t, err)
+
+	open, closes := schedule.Open(monday(10, 0))
+	assert.True(t, open)
+	assert.True(t, monday(20, 0).Equal(closes), "closes at %s", closes)
+
+	always, err := ParseSchedule("Mon-Sun 00:00-24:00", "")
+	require.NoError(t, err)
+	open, closes = always.Open(monday(10, 0))
+	assert.True(t, open)
+	assert.True(t, closes.IsZero(), "A schedule that never closes has no close time")
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"Mon-Fri",
+		"Funday 09:00-17:00",
+		"Mon 09:00",
+		"Mon 09:00-09:00",
+		"Mon 25:00-26:00",
+		"0 9 * * 1-5",
+		"0 9 * * 1-8 8h",
+		"60 9 * * * 8h",
+		"0 9 * * * soon",
+		"0 9 * * * 30s",
+	} {
+		_, err := ParseSchedule(spec, "")
+		assert.Error(t, err, "%q", spec)
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	SetSecretInCache("vendor", map[string]string{"schedule": "Mon-Fri 09:00-17:00", "timezone": "UTC"})
+	SetSecretInCache("employee", map[string]string{"schedule": ""})
+
+	closes, err := CheckSchedule("vendor", monday(10, 0))
+	require.NoError(t, err)
+	assert.True(t, monday(17, 0).Equal(closes))
+
+	_, err = CheckSchedule("vendor", monday(18, 0))
+	assert.Error(t, err)
+
+	closes, err = CheckSchedule("employee", monday(18, 0))
+	require.NoError(t, err)
+	assert.True(t, closes.IsZero(), "Routes without a schedule are not limited")
+}
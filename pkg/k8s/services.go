@@ -0,0 +1,187 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	managedByLabel    = "app.kubernetes.io/managed-by"
+	managedByValue    = "k8s-ssh-router"
+	forwardUserLabel  = "ssh-router/user"
+	sessionAnnotation = "ssh-router/session"
+	routerAnnotation  = "ssh-router/router"
+)
+
+// CheckRemoteForward returns an error unless the user's route lists port in allowedRemotePorts.
+func CheckRemoteForward(username string, port uint32) error {
+	secret, err := GetUserSecret(username)
+	if err != nil {
+		return err
+	}
+	allowed, err := portAllowed(secret["allowedRemotePorts"], port)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("remote forwarding of port %d is not allowed", port)
+	}
+	return nil
+}
+
+// ForwardServiceName returns the Service name used to publish a user's remote forward.
+func ForwardServiceName(username string, port uint32) string {
+	suffix := fmt.Sprintf("-%d", port)
+	name := "ssh-" + sanitizeName(username)
+	if len(name)+len(suffix) > 63 {
+		name = strings.TrimRight(name[:63-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// PublishForward creates a selector-less Service and matching Endpoints so
+// in-cluster clients reaching name:port are sent to address:targetPort. A
+// Service or Endpoints of that name is only replaced when the router created
+// it for a session that has ended; anything else fails the forward. live
+// reports whether a session of this router is still open.
+func PublishForward(clientset kubernetes.Interface, namespace, name, username, session string, port int32, address string, targetPort int32, live func(session string) bool) error {
+	meta := metav1.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels: map[string]string{
+			managedByLabel:   managedByValue,
+			forwardUserLabel: sanitizeName(username),
+		},
+		Annotations: map[string]string{
+			sessionAnnotation: session,
+			routerAnnotation:  address,
+		},
+	}
+	service := &corev1.Service{
+		ObjectMeta: meta,
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{
+				Name:       "forward",
+				Protocol:   corev1.ProtocolTCP,
+				Port:       port,
+				TargetPort: intstr.FromInt32(targetPort),
+			}},
+		},
+	}
+	endpoints := &corev1.Endpoints{
+		ObjectMeta: meta,
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: address}},
+			Ports: []corev1.EndpointPort{{
+				Name:     "forward",
+				Protocol: corev1.ProtocolTCP,
+				Port:     targetPort,
+			}},
+		}},
+	}
+
+	services := clientset.CoreV1().Services(namespace)
+	existing, err := services.Get(context.TODO(), name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		existing = nil
+	case err != nil:
+		return fmt.Errorf("failed to get service %s/%s: %v", namespace, name, err)
+	default:
+		if err := checkStaleForward(clientset, existing.ObjectMeta, address, live); err != nil {
+			return err
+		}
+	}
+	endpointsClient := clientset.CoreV1().Endpoints(namespace)
+	staleEndpoints, err := endpointsClient.Get(context.TODO(), name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		staleEndpoints = nil
+	case err != nil:
+		return fmt.Errorf("failed to get endpoints %s/%s: %v", namespace, name, err)
+	default:
+		if err := checkStaleForward(clientset, staleEndpoints.ObjectMeta, address, live); err != nil {
+			return err
+		}
+	}
+
+	if existing != nil {
+		if err := services.Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to remove stale service %s/%s: %v", namespace, name, err)
+		}
+	}
+	if _, err := services.Create(context.TODO(), service, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create service %s/%s: %v", namespace, name, err)
+	}
+	if staleEndpoints != nil {
+		if err := endpointsClient.Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to remove stale endpoints %s/%s: %v", namespace, name, err)
+		}
+	}
+	if _, err := endpointsClient.Create(context.TODO(), endpoints, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create endpoints %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// checkStaleForward returns an error unless meta belongs to a forward the
+// router published for a session that has ended. Sessions of this router,
+// at address, are asked about with live; those of another router count as
+// ended once no running pod has its address.
+func checkStaleForward(clientset kubernetes.Interface, meta metav1.ObjectMeta, address string, live func(session string) bool) error {
+	if meta.Labels[managedByLabel] != managedByValue {
+		return fmt.Errorf("%s/%s exists and is not managed by the router", meta.Namespace, meta.Name)
+	}
+	session := meta.Annotations[sessionAnnotation]
+	router := meta.Annotations[routerAnnotation]
+	if router == "" || router == address {
+		if live(session) {
+			return fmt.Errorf("%s/%s is forwarded by another session", meta.Namespace, meta.Name)
+		}
+		return nil
+	}
+
+	pods, err := clientset.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("status.podIP", router).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up the router holding %s/%s: %v", meta.Namespace, meta.Name, err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == router && pod.Status.Phase == corev1.PodRunning {
+			return fmt.Errorf("%s/%s is forwarded by the router at %s", meta.Namespace, meta.Name, router)
+		}
+	}
+	return nil
+}
+
+// UnpublishForward deletes the Service and Endpoints created by PublishForward,
+// unless another session has since taken them over.
+func UnpublishForward(clientset kubernetes.Interface, namespace, name, session string) error {
+	service, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get service %s/%s: %v", namespace, name, err)
+	}
+	if service.Annotations[sessionAnnotation] != session {
+		return nil
+	}
+
+	if err := clientset.CoreV1().Services(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete service %s/%s: %v", namespace, name, err)
+	}
+	if err := clientset.CoreV1().Endpoints(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete endpoints %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
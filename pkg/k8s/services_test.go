@@ -0,0 +1,99 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestForwardServiceName(t *testing.T) {
+	assert.Equal(t, "ssh-default-testuser-8080", ForwardServiceName("default-testuser", 8080))
+	assert.Equal(t, "ssh-team-a-jane-doe-3000", ForwardServiceName("Team_A-jane.doe", 3000))
+
+	long := ForwardServiceName(strings.Repeat("a", 100), 65535)
+	assert.LessOrEqual(t, len(long), 63, "Service names must be valid DNS labels")
+	assert.True(t, strings.HasSuffix(long, "-65535"))
+}
+
+func TestPublishForward(t *testing.T) {
+	clientset := clientFake.NewSimpleClientset()
+	name := ForwardServiceName("default-testuser", 8080)
+	live := map[string]bool{"session-1": true}
+	isLive := func(session string) bool { return live[session] }
+
+	err := PublishForward(clientset, "default", name, "default-testuser", "session-1", 8080, "10.0.0.5", 40000, isLive)
+	require.NoError(t, err)
+
+	service, err := clientset.CoreV1().Services("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Nil(t, service.Spec.Selector, "Forward services must not select pods")
+	assert.Equal(t, int32(8080), service.Spec.Ports[0].Port)
+	assert.Equal(t, int32(40000), service.Spec.Ports[0].TargetPort.IntVal)
+
+	endpoints, err := clientset.CoreV1().Endpoints("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.5", endpoints.Subsets[0].Addresses[0].IP)
+	assert.Equal(t, int32(40000), endpoints.Subsets[0].Ports[0].Port)
+
+	// Another session may not take over a live forward
+	err = PublishForward(clientset, "default", name, "default-testuser", "session-2", 8080, "10.0.0.5", 40001, isLive)
+	assert.ErrorContains(t, err, "is forwarded by another session")
+
+	// Once the first session is gone a newer one takes over
+	delete(live, "session-1")
+	live["session-2"] = true
+	err = PublishForward(clientset, "default", name, "default-testuser", "session-2", 8080, "10.0.0.5", 40001, isLive)
+	require.NoError(t, err)
+
+	// The old session ending must leave the new forward in place
+	require.NoError(t, UnpublishForward(clientset, "default", name, "session-1"))
+	_, err = clientset.CoreV1().Services("default").Get(context.TODO(), name, metav1.GetOptions{})
+	assert.NoError(t, err, "Service should still exist")
+
+	require.NoError(t, UnpublishForward(clientset, "default", name, "session-2"))
+	_, err = clientset.CoreV1().Services("default").Get(context.TODO(), name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err), "Service should be deleted")
+	_, err = clientset.CoreV1().Endpoints("default").Get(context.TODO(), name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err), "Endpoints should be deleted")
+}
+
+func TestPublishForwardOwnership(t *testing.T) {
+	name := ForwardServiceName("default-testuser", 8080)
+	ended := func(string) bool { return false }
+
+	clientset := clientFake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	})
+	err := PublishForward(clientset, "default", name, "default-testuser", "session-1", 8080, "10.0.0.5", 40000, ended)
+	assert.ErrorContains(t, err, "is not managed by the router")
+	_, err = clientset.CoreV1().Endpoints("default").Get(context.TODO(), name, metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err), "Nothing is created next to a foreign Service")
+
+	clientset = clientFake.NewSimpleClientset(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	})
+	err = PublishForward(clientset, "default", name, "default-testuser", "session-1", 8080, "10.0.0.5", 40000, ended)
+	assert.ErrorContains(t, err, "is not managed by the router")
+
+	// A forward published by another router is kept while that router runs
+	clientset = clientFake.NewSimpleClientset()
+	require.NoError(t, PublishForward(clientset, "default", name, "default-testuser", "session-1", 8080, "10.0.0.6", 40000, ended))
+	router := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "router-1", Namespace: "ssh"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.6"},
+	}
+	_, err = clientset.CoreV1().Pods("ssh").Create(context.TODO(), router, metav1.CreateOptions{})
+	require.NoError(t, err)
+	err = PublishForward(clientset, "default", name, "default-testuser", "session-2", 8080, "10.0.0.5", 40001, ended)
+	assert.ErrorContains(t, err, "is forwarded by the router at 10.0.0.6")
+
+	require.NoError(t, clientset.CoreV1().Pods("ssh").Delete(context.TODO(), "router-1", metav1.DeleteOptions{}))
+	require.NoError(t, PublishForward(clientset, "default", name, "default-testuser", "session-2", 8080, "10.0.0.5", 40001, ended))
+}
@@ -0,0 +1,180 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// VolumeMountPath is where helper pods mount the claim.
+	VolumeMountPath = "/data"
+	// DefaultHelperImage runs volume helper pods when none is configured.
+	DefaultHelperImage = "busybox:1.36"
+
+	helperContainer = "sftp"
+	// helperUserLabel names the user a helper pod serves.
+	helperUserLabel = "ssh-router/sftp-user"
+	// helperLifetime bounds helper pods the router failed to delete.
+	helperLifetime = 12 * time.Hour
+)
+
+// helperPollInterval and helperStartTimeout bound the wait for a helper pod.
+var (
+	helperPollInterval = time.Second
+	helperStartTimeout = 2 * time.Minute
+)
+
+// StartVolumeHelper schedules a short-lived pod mounting claim and waits for
+// it to run. A ReadWriteOnce claim that is already mounted is only reachable
+// from its node, so the helper is pinned there.
+func StartVolumeHelper(clientset kubernetes.Interface, namespace, claim, image, username string, readOnly bool) (Target, error) {
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), claim, metav1.GetOptions{})
+	if err != nil {
+		return Target{}, fmt.Errorf("failed to get claim %s/%s: %v", namespace, claim, err)
+	}
+	node, err := claimNode(clientset, pvc)
+	if err != nil {
+		return Target{}, err
+	}
+	if image == "" {
+		image = DefaultHelperImage
+	}
+
+	user := sanitizeName(username)
+	name := "ssh-sftp-" + user
+	if len(name) > 57 {
+		name = strings.TrimRight(name[:57], "-")
+	}
+	name += "-" + utilrand.String(5)
+
+	lifetime := int64(helperLifetime.Seconds())
+	grace := int64(0)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				managedByLabel:  managedByValue,
+				helperUserLabel: user,
+			},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:                 corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds:         &lifetime,
+			TerminationGracePeriodSeconds: &grace,
+			Containers: []corev1.Container{{
+				Name:    helperContainer,
+				Image:   image,
+				Command: []string{"sleep", fmt.Sprint(lifetime)},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "data",
+					MountPath: VolumeMountPath,
+					ReadOnly:  readOnly,
+				}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: claim,
+						ReadOnly:  readOnly,
+					},
+				},
+			}},
+		},
+	}
+	if node != "" {
+		pod.Spec.Affinity = &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchFields: []corev1.NodeSelectorRequirement{{
+							Key:      "metadata.name",
+							Operator: corev1.NodeSelectorOpIn,
+							Values:   []string{node},
+						}},
+					}},
+				},
+			},
+		}
+	}
+
+	if _, err := clientset.CoreV1().Pods(namespace).Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+		return Target{}, fmt.Errorf("failed to create helper pod %s/%s: %v", namespace, name, err)
+	}
+	target := Target{Namespace: namespace, Pod: name, Container: helperContainer}
+
+	err = wait.PollUntilContextTimeout(context.TODO(), helperPollInterval, helperStartTimeout, true, func(ctx context.Context) (bool, error) {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch pod.Status.Phase {
+		case corev1.PodRunning:
+			return true, nil
+		case corev1.PodFailed, corev1.PodSucceeded:
+			return false, fmt.Errorf("helper pod %s/%s exited", namespace, name)
+		}
+		return false, nil
+	})
+	if err != nil {
+		StopVolumeHelper(clientset, target)
+		return Target{}, fmt.Errorf("helper pod %s/%s did not start: %v", namespace, name, err)
+	}
+	return target, nil
+}
+
+// StopVolumeHelper deletes a helper pod created by StartVolumeHelper.
+func StopVolumeHelper(clientset kubernetes.Interface, target Target) error {
+	err := clientset.CoreV1().Pods(target.Namespace).Delete(context.TODO(), target.Pod, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete helper pod %s/%s: %v", target.Namespace, target.Pod, err)
+	}
+	return nil
+}
+
+// claimNode returns the node a ReadWriteOnce claim is mounted on, or "" when
+// the helper can be scheduled anywhere.
+func claimNode(clientset kubernetes.Interface, pvc *corev1.PersistentVolumeClaim) (string, error) {
+	shared, oncePod := false, false
+	for _, mode := range pvc.Spec.AccessModes {
+		switch mode {
+		case corev1.ReadWriteMany, corev1.ReadOnlyMany:
+			shared = true
+		case corev1.ReadWriteOncePod:
+			oncePod = true
+		}
+	}
+	if shared {
+		return "", nil
+	}
+
+	pods, err := clientset.CoreV1().Pods(pvc.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods: %v", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil || volume.PersistentVolumeClaim.ClaimName != pvc.Name {
+				continue
+			}
+			if oncePod {
+				return "", fmt.Errorf("claim %s/%s is in use by pod %s", pvc.Namespace, pvc.Name, pod.Name)
+			}
+			return pod.Spec.NodeName, nil
+		}
+	}
+	return "", nil
+}
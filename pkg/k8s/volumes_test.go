@@ -0,0 +1,122 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testClaim(name string, modes ...corev1.PersistentVolumeAccessMode) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "data"},
+		Spec:       corev1.PersistentVolumeClaimSpec{AccessModes: modes},
+	}
+}
+
+func claimConsumer(name, node, claim string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "data"},
+		Spec: corev1.PodSpec{
+			NodeName: node,
+			Volumes: []corev1.Volume{{
+				Name: "data",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+				},
+			}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+// startHelpersRunning makes created helper pods report Running immediately.
+func startHelpersRunning(clientset *clientFake.Clientset) {
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		pod.Status.Phase = corev1.PodRunning
+		return false, nil, nil
+	})
+}
+
+func TestStartVolumeHelper(t *testing.T) {
+	helperPollInterval = 10 * time.Millisecond
+
+	t.Run("pins ReadWriteOnce claims to their node", func(t *testing.T) {
+		clientset := clientFake.NewSimpleClientset(
+			testClaim("db", corev1.ReadWriteOnce),
+			claimConsumer("db-0", "node-a", "db"),
+		)
+		startHelpersRunning(clientset)
+
+		target, err := StartVolumeHelper(clientset, "data", "db", "", "data-Alice", true)
+		require.NoError(t, err)
+		assert.Equal(t, "data", target.Namespace)
+		assert.Equal(t, "sftp", target.Container)
+		assert.Regexp(t, `^ssh-sftp-data-alice-[a-z0-9]{5}$`, target.Pod)
+
+		pod, err := clientset.CoreV1().Pods("data").Get(context.TODO(), target.Pod, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, DefaultHelperImage, pod.Spec.Containers[0].Image)
+		assert.Equal(t, "db", pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName)
+		assert.True(t, pod.Spec.Containers[0].VolumeMounts[0].ReadOnly)
+		assert.Equal(t, []string{"node-a"}, pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchFields[0].Values)
+		assert.Equal(t, managedByValue, pod.Labels[managedByLabel])
+		assert.Equal(t, "data-alice", pod.Labels[helperUserLabel])
+		assert.NotContains(t, pod.Labels, forwardUserLabel, "Selectors for forwards must not match helper pods")
+
+		require.NoError(t, StopVolumeHelper(clientset, target))
+		_, err = clientset.CoreV1().Pods("data").Get(context.TODO(), target.Pod, metav1.GetOptions{})
+		assert.Error(t, err, "The helper pod should be deleted")
+		assert.NoError(t, StopVolumeHelper(clientset, target), "Stopping twice is harmless")
+	})
+
+	t.Run("unused and shared claims schedule anywhere", func(t *testing.T) {
+		clientset := clientFake.NewSimpleClientset(
+			testClaim("scaled-down", corev1.ReadWriteOnce),
+			testClaim("shared", corev1.ReadWriteMany),
+			claimConsumer("shared-0", "node-a", "shared"),
+		)
+		startHelpersRunning(clientset)
+
+		for _, claim := range []string{"scaled-down", "shared"} {
+			target, err := StartVolumeHelper(clientset, "data", claim, "registry.local/busybox", "data-bob", false)
+			require.NoError(t, err)
+			pod, err := clientset.CoreV1().Pods("data").Get(context.TODO(), target.Pod, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Nil(t, pod.Spec.Affinity, claim)
+			assert.Equal(t, "registry.local/busybox", pod.Spec.Containers[0].Image)
+		}
+	})
+
+	t.Run("claims in use by one pod only are refused", func(t *testing.T) {
+		clientset := clientFake.NewSimpleClientset(
+			testClaim("exclusive", corev1.ReadWriteOncePod),
+			claimConsumer("exclusive-0", "node-a", "exclusive"),
+		)
+		_, err := StartVolumeHelper(clientset, "data", "exclusive", "", "data-bob", false)
+		assert.Error(t, err)
+	})
+
+	t.Run("helpers that never start are removed", func(t *testing.T) {
+		helperStartTimeout = 50 * time.Millisecond
+		defer func() { helperStartTimeout = 2 * time.Minute }()
+		clientset := clientFake.NewSimpleClientset(testClaim("db", corev1.ReadWriteOnce))
+
+		_, err := StartVolumeHelper(clientset, "data", "db", "", "data-bob", false)
+		assert.Error(t, err)
+		pods, err := clientset.CoreV1().Pods("data").List(context.TODO(), metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, pods.Items)
+	})
+
+	_, err := StartVolumeHelper(clientFake.NewSimpleClientset(), "data", "missing", "", "data-bob", false)
+	assert.Error(t, err)
+}
@@ -14,8 +14,33 @@ var activeSessions = prometheus.NewGauge(prometheus.GaugeOpts{
 	Help: "Number of active SSH sessions",
 })
 
+var sessionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ssh_sessions_rejected_total",
+	Help: "Number of SSH sessions rejected by a session limit",
+}, []string{"limit"})
+
+var unauthenticatedConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ssh_unauthenticated_connections",
+	Help: "Number of SSH connections that have not completed authentication",
+})
+
+var connectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ssh_connections_rejected_total",
+	Help: "Number of SSH connections rejected before the handshake",
+}, []string{"reason"})
+
+var handshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ssh_handshake_failures_total",
+	Help: "Number of SSH handshakes that failed or timed out",
+}, []string{"reason"})
+
+var negotiatedAlgorithms = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ssh_negotiated_algorithms_total",
+	Help: "Number of SSH connections by negotiated algorithm",
+}, []string{"type", "direction", "algorithm"})
+
 func init() {
-	prometheus.MustRegister(activeSessions)
+	prometheus.MustRegister(activeSessions, sessionsRejected, unauthenticatedConnections, connectionsRejected, handshakeFailures, negotiatedAlgorithms)
 }
 
 func StartMetricsServer(port int) {
@@ -31,3 +56,37 @@ func IncActiveSessions() {
 func DecActiveSessions() {
 	activeSessions.Dec()
 }
+
+// IncSessionsRejected counts a session refused by the named limit: user,
+// namespace or router.
+func IncSessionsRejected(limit string) {
+	sessionsRejected.WithLabelValues(limit).Inc()
+}
+
+func IncUnauthenticatedConnections() {
+	unauthenticatedConnections.Inc()
+}
+
+func DecUnauthenticatedConnections() {
+	unauthenticatedConnections.Dec()
+}
+
+// IncConnectionsRejected counts a connection closed before its handshake:
+// rate_limit or unauthenticated_limit.
+func IncConnectionsRejected(reason string) {
+	connectionsRejected.WithLabelValues(reason).Inc()
+}
+
+// IncHandshakeFailures counts a failed handshake: timeout,
+// no_common_algorithm, max_auth_tries, auth or error.
+func IncHandshakeFailures(reason string) {
+	handshakeFailures.WithLabelValues(reason).Inc()
+}
+
+// IncNegotiatedAlgorithm counts a connection that negotiated algorithm for
+// type: kex, hostkey, cipher or mac. Ciphers and MACs are negotiated per
+// direction, client_to_server or server_to_client; direction is empty for
+// the others.
+func IncNegotiatedAlgorithm(kind, direction, algorithm string) {
+	negotiatedAlgorithms.WithLabelValues(kind, direction, algorithm).Inc()
+}
@@ -3,9 +3,12 @@ package metrics
 import (
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStartMetricsServer(t *testing.T) {
@@ -14,8 +17,13 @@ func TestStartMetricsServer(t *testing.T) {
 	req, err := http.NewRequest("GET", "http://127.0.0.1:2113/metrics", nil)
 	assert.NoError(t, err, "Failed to create request")
 
-	resp, err := http.DefaultClient.Do(req)
-	assert.NoError(t, err, "Failed to get response")
+	// The server starts listening in the background
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.DefaultClient.Do(req)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "Failed to get response")
+	defer resp.Body.Close()
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
 }
@@ -51,3 +59,13 @@ func TestActiveSessions(t *testing.T) {
 	}
 	assert.True(t, found, "Expected active_ssh_sessions metric to be found")
 }
+
+func TestSessionsRejected(t *testing.T) {
+	IncSessionsRejected("user")
+	IncSessionsRejected("user")
+	IncSessionsRejected("router")
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(sessionsRejected.WithLabelValues("user")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(sessionsRejected.WithLabelValues("router")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(sessionsRejected.WithLabelValues("namespace")))
+}
@@ -0,0 +1,184 @@
+package sshserver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithms are the SSH algorithms the router offers, in order of
+// preference.
+type Algorithms struct {
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+	// HostKeyAlgorithms are the signature algorithms the router may use with
+	// its host keys; keys with none of them are not served.
+	HostKeyAlgorithms []string
+	// PublicKeyAlgorithms are accepted for user public key authentication.
+	PublicKeyAlgorithms []string
+}
+
+// AlgorithmProfiles are the named algorithm sets selectable with
+// Options.AlgorithmProfile.
+var AlgorithmProfiles = map[string]Algorithms{
+	// default is what golang.org/x/crypto/ssh offers when left unset
+	"default": {
+		KeyExchanges: []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1"},
+		Ciphers:      []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr"},
+		MACs:         []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96"},
+		HostKeyAlgorithms: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+		},
+		PublicKeyAlgorithms: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256,
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+		},
+	},
+	// modern drops SHA-1, DSA and encrypt-and-MAC modes
+	"modern": {
+		KeyExchanges: []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp521", "ecdh-sha2-nistp384", "ecdh-sha2-nistp256", "diffie-hellman-group16-sha512"},
+		Ciphers:      []string{"chacha20-poly1305@openssh.com", "aes256-gcm@openssh.com", "aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"},
+		MACs:         []string{"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com"},
+		HostKeyAlgorithms: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+		PublicKeyAlgorithms: []string{
+			ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256,
+			ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+	},
+	// fips only offers algorithms approved by FIPS 140-3: NIST curves, AES
+	// and SHA-2. It does not make the Go crypto module itself validated.
+	"fips": {
+		KeyExchanges: []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group16-sha512", "diffie-hellman-group14-sha256"},
+		Ciphers:      []string{"aes256-gcm@openssh.com", "aes128-gcm@openssh.com", "aes256-ctr", "aes192-ctr", "aes128-ctr"},
+		MACs:         []string{"hmac-sha2-512-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512", "hmac-sha2-256"},
+		HostKeyAlgorithms: []string{
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+		PublicKeyAlgorithms: []string{
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoSKECDSA256,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+	},
+}
+
+// supportedAlgorithms are those golang.org/x/crypto/ssh implements for
+// servers. It drops names it does not know without an error, so they are
+// checked here instead.
+var supportedAlgorithms = Algorithms{
+	KeyExchanges: []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	},
+	Ciphers: []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	},
+	MACs: []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96"},
+	HostKeyAlgorithms: []string{
+		ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	},
+	PublicKeyAlgorithms: []string{
+		ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	},
+}
+
+// serverAlgorithms resolves opts.AlgorithmProfile, "default" when empty, and
+// replaces any list opts sets explicitly.
+func serverAlgorithms(opts Options) (Algorithms, error) {
+	name := opts.AlgorithmProfile
+	if name == "" {
+		name = "default"
+	}
+	profile, ok := AlgorithmProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(AlgorithmProfiles))
+		for name := range AlgorithmProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return Algorithms{}, fmt.Errorf("unknown algorithm profile %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+
+	for _, list := range []struct {
+		kind       string
+		override   []string
+		algorithms *[]string
+		supported  []string
+	}{
+		{"key exchange", opts.KeyExchanges, &profile.KeyExchanges, supportedAlgorithms.KeyExchanges},
+		{"cipher", opts.Ciphers, &profile.Ciphers, supportedAlgorithms.Ciphers},
+		{"MAC", opts.MACs, &profile.MACs, supportedAlgorithms.MACs},
+		{"host key algorithm", opts.HostKeyAlgorithms, &profile.HostKeyAlgorithms, supportedAlgorithms.HostKeyAlgorithms},
+		{"public key algorithm", opts.PublicKeyAlgorithms, &profile.PublicKeyAlgorithms, supportedAlgorithms.PublicKeyAlgorithms},
+	} {
+		if len(list.override) > 0 {
+			*list.algorithms = list.override
+		}
+		for _, algorithm := range *list.algorithms {
+			if !contains(list.supported, algorithm) {
+				return Algorithms{}, fmt.Errorf("unsupported %s %q", list.kind, algorithm)
+			}
+		}
+	}
+	return profile, nil
+}
+
+// apply sets the algorithms of config, except host key algorithms, which
+// restrictHostKey applies to each key.
+func (a Algorithms) apply(config *ssh.ServerConfig) {
+	config.KeyExchanges = a.KeyExchanges
+	config.Ciphers = a.Ciphers
+	config.MACs = a.MACs
+	config.PublicKeyAuthAlgorithms = a.PublicKeyAlgorithms
+}
+
+func (a Algorithms) String() string {
+	return fmt.Sprintf("kex=%s ciphers=%s macs=%s hostkeys=%s pubkeys=%s",
+		strings.Join(a.KeyExchanges, ","), strings.Join(a.Ciphers, ","), strings.Join(a.MACs, ","),
+		strings.Join(a.HostKeyAlgorithms, ","), strings.Join(a.PublicKeyAlgorithms, ","))
+}
+
+// restrictHostKey limits signer to the allowed signature algorithms. It
+// returns false when the key can use none of them. An empty allowed list
+// leaves the key as it is.
+func restrictHostKey(signer ssh.Signer, allowed []string) (ssh.Signer, bool) {
+	if len(allowed) == 0 {
+		return signer, true
+	}
+	keyType := signer.PublicKey().Type()
+	candidates := []string{keyType}
+	if keyType == ssh.KeyAlgoRSA {
+		candidates = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	var algorithms []string
+	for _, algorithm := range candidates {
+		if contains(allowed, algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	if len(algorithms) == 0 {
+		return nil, false
+	}
+
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return signer, len(algorithms) == len(candidates)
+	}
+	restricted, err := ssh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+	if err != nil {
+		return nil, false
+	}
+	return restricted, true
+}
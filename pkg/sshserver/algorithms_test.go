@@ -0,0 +1,207 @@
+package sshserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServerAlgorithms(t *testing.T) {
+	algorithms, err := serverAlgorithms(Options{})
+	require.NoError(t, err)
+	assert.Equal(t, AlgorithmProfiles["default"], algorithms)
+
+	for name := range AlgorithmProfiles {
+		_, err := serverAlgorithms(Options{AlgorithmProfile: name})
+		assert.NoError(t, err, "Profile %s only uses supported algorithms", name)
+	}
+
+	algorithms, err = serverAlgorithms(Options{AlgorithmProfile: "fips", Ciphers: []string{"aes256-gcm@openssh.com"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aes256-gcm@openssh.com"}, algorithms.Ciphers, "Explicit lists replace the profile's")
+	assert.Equal(t, AlgorithmProfiles["fips"].MACs, algorithms.MACs)
+
+	_, err = serverAlgorithms(Options{AlgorithmProfile: "paranoid"})
+	assert.ErrorContains(t, err, `unknown algorithm profile "paranoid", expected one of default, fips, modern`)
+	_, err = serverAlgorithms(Options{MACs: []string{"hmac-md5"}})
+	assert.ErrorContains(t, err, `unsupported MAC "hmac-md5"`)
+	_, err = serverAlgorithms(Options{KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}})
+	assert.Error(t, err, "Group exchange is not implemented for servers")
+}
+
+func TestRestrictHostKey(t *testing.T) {
+	keys, err := parseHostKeys(testHostKeys(t))
+	require.NoError(t, err)
+	fips := AlgorithmProfiles["fips"].HostKeyAlgorithms
+
+	assert.Equal(t, 2, keys.usable(fips), "The ECDSA and RSA keys are usable, the ed25519 keys are not")
+	assert.Equal(t, 4, keys.usable(nil))
+
+	for _, signer := range keys.signers {
+		restricted, ok := restrictHostKey(signer, fips)
+		if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+			continue
+		}
+		require.True(t, ok)
+		multi, ok := restricted.(ssh.MultiAlgorithmSigner)
+		require.True(t, ok)
+		assert.Equal(t, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256}, multi.Algorithms(), "SHA-1 signatures are dropped")
+	}
+}
+
+// dialWithAlgorithms runs a handshake between a client with clientConfig and
+// a server using the profile, returning what the server saw negotiated.
+func dialWithAlgorithms(t *testing.T, profile string, clientConfig *ssh.ClientConfig) (Negotiated, error) {
+	algorithms, err := serverAlgorithms(Options{AlgorithmProfile: profile})
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keys, err := parseHostKeys(map[string][]byte{
+		"ssh_host_ecdsa_key":   hostKeyPEM(t, ecdsaKey),
+		"ssh_host_ed25519_key": hostKeyPEM(t, ed25519Key),
+	})
+	require.NoError(t, err)
+	base := &ssh.ServerConfig{NoClientAuth: true}
+	algorithms.apply(base)
+	serverConfig := keys.serverConfig(base, algorithms.HostKeyAlgorithms)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	negotiated := make(chan Negotiated, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		sniffer := newKexSniffer(conn)
+		sshConn, _, _, err := ssh.NewServerConn(sniffer, serverConfig)
+		if err != nil {
+			conn.Close()
+			close(negotiated)
+			return
+		}
+		defer sshConn.Close()
+		n, ok := sniffer.negotiated()
+		require.True(t, ok)
+		negotiated <- n
+	}()
+
+	clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	client, err := ssh.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		<-negotiated
+		return Negotiated{}, err
+	}
+	defer client.Close()
+	return <-negotiated, nil
+}
+
+func TestAlgorithmProfileHandshake(t *testing.T) {
+	negotiated, err := dialWithAlgorithms(t, "fips", &ssh.ClientConfig{
+		Config: ssh.Config{
+			Ciphers: []string{"chacha20-poly1305@openssh.com", "aes128-ctr"},
+			MACs:    []string{"hmac-sha1", "hmac-sha2-256"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Negotiated{
+		KeyExchange: "ecdh-sha2-nistp256",
+		HostKey:     ssh.KeyAlgoECDSA256,
+		CipherIn:    "aes128-ctr",
+		CipherOut:   "aes128-ctr",
+		MACIn:       "hmac-sha2-256",
+		MACOut:      "hmac-sha2-256",
+	}, negotiated)
+
+	negotiated, err = dialWithAlgorithms(t, "modern", &ssh.ClientConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, "curve25519-sha256", negotiated.KeyExchange)
+	assert.Equal(t, ssh.KeyAlgoECDSA256, negotiated.HostKey, "The Go client prefers ECDSA host keys")
+	assert.Empty(t, negotiated.MACIn, "AEAD ciphers need no MAC")
+
+	_, err = dialWithAlgorithms(t, "fips", &ssh.ClientConfig{HostKeyAlgorithms: []string{ssh.KeyAlgoED25519}})
+	assert.ErrorContains(t, err, "no common algorithm", "The fips profile does not serve ed25519 host keys")
+	_, err = dialWithAlgorithms(t, "fips", &ssh.ClientConfig{Config: ssh.Config{KeyExchanges: []string{"curve25519-sha256"}}})
+	assert.ErrorContains(t, err, "no common algorithm")
+}
+
+func TestKexInitParser(t *testing.T) {
+	payload := ssh.Marshal(&kexInit{
+		KexAlgos:            []string{"curve25519-sha256", "ext-info-c"},
+		ServerHostKeyAlgos:  []string{ssh.KeyAlgoED25519},
+		CiphersClientServer: []string{"aes128-ctr"},
+		CiphersServerClient: []string{"aes128-ctr"},
+		MACsClientServer:    []string{"hmac-sha2-256"},
+		MACsServerClient:    []string{"hmac-sha2-256"},
+	})
+	padding := 8 - (len(payload)+5)%8 + 4
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	packet = append(packet, make([]byte, padding)...)
+	stream := append([]byte("banner line\r\nSSH-2.0-OpenSSH_9.6\r\n"), packet...)
+
+	// Data arrives in arbitrary pieces
+	parser := &kexInitParser{}
+	for i := range stream {
+		parser.feed(stream[i : i+1])
+	}
+	require.NotNil(t, parser.msg)
+	assert.Equal(t, []string{"curve25519-sha256", "ext-info-c"}, parser.msg.KexAlgos)
+	assert.Equal(t, []string{"hmac-sha2-256"}, parser.msg.MACsServerClient)
+
+	garbage := &kexInitParser{}
+	garbage.feed([]byte("SSH-2.0-x\r\n\xff\xff\xff\xff\x00"))
+	assert.True(t, garbage.done)
+	assert.Nil(t, garbage.msg)
+}
+
+func TestReportNegotiatedCountsBothDirections(t *testing.T) {
+	serverConn, _, _, _ := newTestConnPair(t, "default-alice")
+	reportNegotiated(serverConn, Negotiated{
+		KeyExchange: "test-kex",
+		HostKey:     "test-hostkey",
+		CipherIn:    "test-cipher-in",
+		CipherOut:   "test-cipher-out",
+		MACIn:       "test-mac-in",
+		MACOut:      "test-mac-out",
+	})
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	counted := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "ssh_negotiated_algorithms_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			counted[labels["type"]+"/"+labels["direction"]+"/"+labels["algorithm"]] = metric.GetCounter().GetValue()
+		}
+	}
+	for _, series := range []string{
+		"kex//test-kex",
+		"hostkey//test-hostkey",
+		"cipher/client_to_server/test-cipher-in",
+		"cipher/server_to_client/test-cipher-out",
+		"mac/client_to_server/test-mac-in",
+		"mac/server_to_client/test-mac-out",
+	} {
+		assert.Equal(t, 1.0, counted[series], series)
+	}
+}
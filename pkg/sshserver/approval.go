@@ -0,0 +1,134 @@
+package sshserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/kubernetes"
+)
+
+// approvalGate holds the channels of a connection whose route requires
+// approval until an approver decides on its access request. Once approved,
+// the session ends when the approval expires; denials and timeouts close the
+// connection. All methods are safe on a nil receiver, which lets everything
+// through.
+type approvalGate struct {
+	conn ssh.Conn
+	name string
+
+	mu      sync.Mutex
+	waiting map[ssh.Channel]struct{}
+	done    chan struct{}
+	err     error
+}
+
+// newApprovalGate records an access request in namespace for routes that
+// require one and starts waiting for its approval until ctx ends.
+func newApprovalGate(ctx context.Context, clientset kubernetes.Interface, conn ssh.Conn, timeouts *connTimeouts, namespace string) (*approvalGate, error) {
+	if !k8s.RequiresApproval(conn.User()) {
+		return nil, nil
+	}
+	ttl, timeout := k8s.ApprovalDurations(conn.User())
+	request, err := k8s.RequestAccess(clientset, namespace, conn.User(), ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &approvalGate{
+		conn:    conn,
+		name:    request.String(),
+		waiting: make(map[ssh.Channel]struct{}),
+		done:    make(chan struct{}),
+	}
+	if !request.Expires.IsZero() {
+		log.Printf("Reusing access request %s of %s, approved until %s", request, conn.User(), request.Expires.Format("15:04:05 MST"))
+		close(g.done)
+		timeouts.limit(request.Expires, "access approval expired")
+		return g, nil
+	}
+
+	log.Printf("Created access request %s for %s", request, conn.User())
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		approved, err := k8s.WaitForApproval(ctx, clientset, request, ttl)
+		g.decide(approved, err, timeouts)
+	}()
+	return g, nil
+}
+
+// decide releases or refuses the waiting channels.
+func (g *approvalGate) decide(request k8s.AccessRequest, err error, timeouts *connTimeouts) {
+	g.mu.Lock()
+	g.err = err
+	close(g.done)
+	waiting := make([]ssh.Channel, 0, len(g.waiting))
+	for channel := range g.waiting {
+		waiting = append(waiting, channel)
+	}
+	g.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Access of %s refused: %v", g.conn.User(), err)
+		for _, channel := range waiting {
+			fmt.Fprintf(channel.Stderr(), "k8s-ssh-router: %v\r\n", err)
+			channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 1}))
+			channel.Close()
+		}
+		g.conn.Close()
+		return
+	}
+
+	log.Printf("Access request %s of %s approved by %q until %s", request, g.conn.User(), request.ApprovedBy, request.Expires.Format("15:04:05 MST"))
+	for _, channel := range waiting {
+		fmt.Fprintf(channel.Stderr(), "k8s-ssh-router: access approved until %s\r\n", request.Expires.Format("15:04:05 MST"))
+	}
+	if timeouts != nil {
+		// Waiting for the approver does not count as idling
+		timeouts.touch()
+	}
+	timeouts.limit(request.Expires, "access approval expired")
+}
+
+// wait blocks a session channel until the request is decided, telling the
+// user what they are waiting for.
+func (g *approvalGate) wait(channel ssh.Channel) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	select {
+	case <-g.done:
+		g.mu.Unlock()
+		return g.err
+	default:
+	}
+	g.waiting[channel] = struct{}{}
+	g.mu.Unlock()
+
+	fmt.Fprintf(channel.Stderr(), "k8s-ssh-router: waiting for approval of access request %s\r\n", g.name)
+	<-g.done
+
+	g.mu.Lock()
+	delete(g.waiting, channel)
+	g.mu.Unlock()
+	return g.err
+}
+
+// check returns an error unless the request has been approved, for requests
+// that cannot wait such as port forwards.
+func (g *approvalGate) check() error {
+	if g == nil {
+		return nil
+	}
+	select {
+	case <-g.done:
+		return g.err
+	default:
+		return fmt.Errorf("access request %s is waiting for approval", g.name)
+	}
+}
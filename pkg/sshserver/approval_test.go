@@ -0,0 +1,109 @@
+package sshserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApprovalGateDenied(t *testing.T) {
+	k8s.SetSecretInCache("prod-alice", map[string]string{"service": "prod", "requireApproval": "true"})
+	clientset := clientFake.NewSimpleClientset()
+	serverConn, serverChans, clientConn, _ := newTestConnPair(t, "prod-alice")
+
+	gate, err := newApprovalGate(context.Background(), clientset, serverConn, nil, "ssh-router")
+	require.NoError(t, err)
+	require.NotNil(t, gate)
+	assert.ErrorContains(t, gate.check(), "is waiting for approval", "Port forwards are refused until approved")
+
+	refused := make(chan error, 1)
+	go func() {
+		channel, reqs, err := (<-serverChans).Accept()
+		require.NoError(t, err)
+		go ssh.DiscardRequests(reqs)
+		refused <- gate.wait(channel)
+	}()
+	clientChannel, reqs, err := clientConn.OpenChannel("session", nil)
+	require.NoError(t, err)
+	go ssh.DiscardRequests(reqs)
+	stderr := &syncBuffer{}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := clientChannel.Stderr().Read(buf)
+			stderr.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	require.Eventually(t, func() bool { return stderr.String() != "" }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, stderr.String(), "waiting for approval of access request ssh-router/ssh-access-prod-alice-")
+
+	requests, err := clientset.CoreV1().ConfigMaps("ssh-router").List(context.TODO(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, requests.Items, 1)
+	record := requests.Items[0]
+	record.Annotations["ssh-router/approval"] = k8s.ApprovalDenied
+	_, err = clientset.CoreV1().ConfigMaps("ssh-router").Update(context.TODO(), &record, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	select {
+	case err := <-refused:
+		assert.ErrorIs(t, err, k8s.ErrAccessDenied)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Denied session was not released")
+	}
+	select {
+	case <-waitClosed(clientConn):
+	case <-time.After(5 * time.Second):
+		t.Fatal("Denied connection was not closed")
+	}
+	assert.Eventually(t, func() bool { return strings.Contains(stderr.String(), "access request denied") }, 5*time.Second, 10*time.Millisecond,
+		"The user should be told why the session ended")
+}
+
+func TestApprovalGateReusesApproval(t *testing.T) {
+	k8s.SetSecretInCache("prod-bob", map[string]string{"service": "prod", "requireApproval": "true"})
+	approvedAt := time.Now().Add(-10 * time.Minute).UTC().Truncate(time.Second)
+	clientset := clientFake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ssh-access-prod-bob-abcde",
+			Namespace: "ssh-router",
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": "k8s-ssh-router",
+				"ssh-router/access-request":    "true",
+				"ssh-router/access-user":       "prod-bob",
+			},
+			Annotations: map[string]string{
+				"ssh-router/approval":    k8s.ApprovalApproved,
+				"ssh-router/approved-at": approvedAt.Format(time.RFC3339),
+				"ssh-router/expires-at":  approvedAt.Add(24 * time.Hour).Format(time.RFC3339),
+			},
+		},
+		Data: map[string]string{"user": "prod-bob"},
+	})
+	serverConn, _, _, _ := newTestConnPair(t, "prod-bob")
+	timeouts := newConnTimeouts(serverConn, Options{})
+
+	gate, err := newApprovalGate(context.Background(), clientset, serverConn, timeouts, "ssh-router")
+	require.NoError(t, err)
+	assert.NoError(t, gate.check())
+	assert.Equal(t, approvedAt.Add(k8s.DefaultApprovalTTL), timeouts.deadline.UTC(), "The session ends once the approval TTL has passed")
+
+	k8s.SetSecretInCache("prod-carol", map[string]string{"service": "prod"})
+	serverConn, _, _, _ = newTestConnPair(t, "prod-carol")
+	gate, err = newApprovalGate(context.Background(), clientset, serverConn, nil, "ssh-router")
+	require.NoError(t, err)
+	assert.Nil(t, gate, "Routes without requireApproval are not gated")
+	assert.NoError(t, gate.check())
+}
@@ -0,0 +1,52 @@
+package sshserver
+
+import (
+	"log"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// directTCPIPPayload is the extra data of a direct-tcpip channel open (RFC 4254 7.2).
+type directTCPIPPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// handleDirectTCPIP serves `ssh -L` forwards by tunnelling the channel to the
+// requested port on the user's pod. The destination host is ignored: the
+// tunnel always terminates inside the pod's network namespace.
+func handleDirectTCPIP(clientset kubernetes.Interface, restClient rest.Interface, config *rest.Config, dialer httpstream.Dialer, newChannel ssh.NewChannel, username string, timeouts *connTimeouts) {
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		log.Printf("Invalid direct-tcpip payload: %v", err)
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip payload")
+		return
+	}
+
+	log.Printf("Received direct-tcpip request for %s:%d from %s:%d", payload.Host, payload.Port, payload.OriginHost, payload.OriginPort)
+	// The target is resolved and reviewed once, before the channel is accepted
+	secret, target, err := k8s.PortForwardTarget(clientset, username, payload.Port)
+	if err != nil {
+		log.Printf("Port forward denied for %s: %v", username, err)
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.Printf("Could not accept channel: %v", err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	if err := k8s.PortForwardToTarget(restClient, dialer, config, secret, target, payload.Port, timeouts.trackInput(channel)); err != nil {
+		log.Printf("Port forward to pod failed: %v", err)
+	}
+}
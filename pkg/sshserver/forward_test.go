@@ -0,0 +1,92 @@
+package sshserver
+
+import (
+	"testing"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type mockNewChannel struct {
+	channelType  string
+	extraData    []byte
+	rejectReason ssh.RejectionReason
+	accepted     bool
+}
+
+func (m *mockNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	m.accepted = true
+	return nil, nil, assert.AnError
+}
+
+func (m *mockNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	m.rejectReason = reason
+	return nil
+}
+
+func (m *mockNewChannel) ChannelType() string { return m.channelType }
+func (m *mockNewChannel) ExtraData() []byte   { return m.extraData }
+
+func TestHandleDirectTCPIP(t *testing.T) {
+	k8s.SetSecretInCache("default-forwarduser", map[string]string{
+		"service":         "default",
+		"secretNamespace": "default",
+		"allowedPorts":    "5432",
+		"kubernetesUser":  "forwarder@example.com",
+	})
+	clientset := clientFake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default"},
+	})
+	var reviews []string
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviews = append(reviews, review.Spec.ResourceAttributes.Name)
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+	config := &rest.Config{Host: "http://localhost"}
+
+	t.Run("disallowed port is rejected", func(t *testing.T) {
+		newChannel := &mockNewChannel{
+			channelType: "direct-tcpip",
+			extraData:   ssh.Marshal(directTCPIPPayload{Host: "localhost", Port: 22, OriginHost: "127.0.0.1", OriginPort: 50000}),
+		}
+		handleDirectTCPIP(clientset, nil, config, nil, newChannel, "default-forwarduser", nil)
+		assert.Equal(t, ssh.Prohibited, newChannel.rejectReason)
+		assert.False(t, newChannel.accepted)
+	})
+
+	t.Run("allowed port is accepted", func(t *testing.T) {
+		newChannel := &mockNewChannel{
+			channelType: "direct-tcpip",
+			extraData:   ssh.Marshal(directTCPIPPayload{Host: "localhost", Port: 5432, OriginHost: "127.0.0.1", OriginPort: 50000}),
+		}
+		handleDirectTCPIP(clientset, nil, config, nil, newChannel, "default-forwarduser", nil)
+		assert.True(t, newChannel.accepted)
+		assert.Equal(t, []string{"db-0"}, reviews, "The target is resolved and reviewed once")
+	})
+
+	t.Run("route without a pod is rejected", func(t *testing.T) {
+		newChannel := &mockNewChannel{
+			channelType: "direct-tcpip",
+			extraData:   ssh.Marshal(directTCPIPPayload{Host: "localhost", Port: 5432, OriginHost: "127.0.0.1", OriginPort: 50000}),
+		}
+		handleDirectTCPIP(clientFake.NewSimpleClientset(), nil, config, nil, newChannel, "default-forwarduser", nil)
+		assert.Equal(t, ssh.Prohibited, newChannel.rejectReason)
+		assert.False(t, newChannel.accepted)
+	})
+
+	t.Run("malformed payload is rejected", func(t *testing.T) {
+		newChannel := &mockNewChannel{channelType: "direct-tcpip", extraData: []byte{1, 2}}
+		handleDirectTCPIP(clientset, nil, config, nil, newChannel, "default-forwarduser", nil)
+		assert.Equal(t, ssh.ConnectionFailed, newChannel.rejectReason)
+	})
+}
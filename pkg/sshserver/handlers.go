@@ -1,16 +1,26 @@
 package sshserver
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
+	"net/url"
+	"time"
 
 	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/davidcollom/k8s-ssh-router/pkg/metrics"
 	"golang.org/x/crypto/ssh"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
-func handleSSHRequests(clientset kubernetes.Interface, restClient rest.Interface, config *rest.Config, executor k8s.Executor, channel ssh.Channel, requests <-chan *ssh.Request, username string) {
+// exitStatus is the payload of an exit-status channel request (RFC 4254 6.10).
+type exitStatus struct {
+	Status uint32
+}
+
+func handleSSHRequests(clientset kubernetes.Interface, restClient rest.Interface, config *rest.Config, executor k8s.Executor, channel ssh.Channel, requests <-chan *ssh.Request, username string, opts Options) {
 	isTerminal := false
 	for req := range requests {
 		switch req.Type {
@@ -20,6 +30,22 @@ func handleSSHRequests(clientset kubernetes.Interface, restClient rest.Interface
 		case "exec":
 			command := string(req.Payload[4:])
 			log.Printf("Received exec request: %s", command)
+			command, err := k8s.RouteCommand(username, command)
+			if err != nil {
+				refuseCommand(channel, req, username, err)
+				continue
+			}
+			if scp, ok := parseSCPCommand(command); ok {
+				status := uint32(0)
+				if err := handleSCP(clientset, restClient, config, executor, channel, username, scp); err != nil {
+					log.Printf("SCP transfer failed: %v", err)
+					channel.Stderr().Write([]byte(err.Error() + "\n"))
+					status = 1
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: status}))
+				channel.Close()
+				continue
+			}
 			if err := k8s.ExecInPod(clientset, restClient, executor, config, username, command, channel, isTerminal); err != nil {
 				log.Printf("Exec in pod failed: %v", err)
 				channel.Stderr().Write([]byte(err.Error()))
@@ -27,21 +53,41 @@ func handleSSHRequests(clientset kubernetes.Interface, restClient rest.Interface
 			channel.Close()
 		case "shell":
 			log.Printf("Received shell request")
-			if err := k8s.ExecInPod(clientset, restClient, executor, config, username, "", channel, isTerminal); err != nil {
+			command, err := k8s.RouteCommand(username, "")
+			if err != nil {
+				refuseCommand(channel, req, username, err)
+				continue
+			}
+			if err := k8s.ExecInPod(clientset, restClient, executor, config, username, command, channel, isTerminal); err != nil {
 				log.Printf("Exec in pod failed: %v", err)
 				channel.Stderr().Write([]byte(err.Error()))
 			}
 			channel.Close()
-		// case "subsystem":
-		// 	subsystem := string(req.Payload[4:])
-		// 	if subsystem == "sftp" {
-		// 		log.Printf("Received sftp request")
-		// 		req.Reply(true, nil)
-		// 		go handleSFTP(channel)
-		// 	} else {
-		// 		log.Printf("Unknown subsystem request: %s", subsystem)
-		// 		req.Reply(false, nil)
-		// 	}
+		case "subsystem":
+			subsystem := string(req.Payload[4:])
+			if subsystem != "sftp" {
+				log.Printf("Unknown subsystem request: %s", subsystem)
+				req.Reply(false, nil)
+				continue
+			}
+			log.Printf("Received sftp request")
+			if k8s.CommandsRestricted(username) {
+				refuseCommand(channel, req, username, fmt.Errorf("subsystems are not allowed"))
+				continue
+			}
+			handler, release, err := newSFTPHandler(clientset, restClient, config, executorFactory(executor), username, opts.SFTPHelperImage)
+			if err != nil {
+				log.Printf("SFTP routing failed: %v", err)
+				channel.Stderr().Write([]byte(err.Error()))
+				req.Reply(false, nil)
+				channel.Close()
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				handleSFTP(channel, handler)
+				release()
+			}()
 		default:
 			log.Printf("Unknown request type: %s", req.Type)
 			req.Reply(false, nil)
@@ -49,29 +95,118 @@ func handleSSHRequests(clientset kubernetes.Interface, restClient rest.Interface
 	}
 }
 
-func HandleSSHConnection(conn net.Conn, sshConfig *ssh.ServerConfig, clientset kubernetes.Interface, restConfig *rest.Config) {
-	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
+// refuseCommand rejects a request the route's command rules do not allow.
+func refuseCommand(channel ssh.Channel, req *ssh.Request, username string, err error) {
+	log.Printf("Refused %s request for %s: %v", req.Type, username, err)
+	req.Reply(false, nil)
+	channel.Stderr().Write([]byte(err.Error() + "\n"))
+	channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 1}))
+	channel.Close()
+}
+
+// executorFactory reuses an injected executor for every command, or returns
+// nil so callers fall back to SPDY.
+func executorFactory(executor k8s.Executor) k8s.ExecutorFactory {
+	if executor == nil {
+		return nil
+	}
+	return func(*rest.Config, string, *url.URL) (k8s.Executor, error) {
+		return executor, nil
+	}
+}
+
+func HandleSSHConnection(conn net.Conn, sshConfig *ssh.ServerConfig, clientset kubernetes.Interface, restConfig *rest.Config, opts Options) {
+	authenticated, err := handshakes.admit(conn.RemoteAddr(), opts)
+	if err != nil {
+		log.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if opts.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(opts.HandshakeTimeout))
+	}
+	sniffer := newKexSniffer(conn)
+	sshConn, chans, reqs, err := ssh.NewServerConn(sniffer, sshConfig)
+	authenticated()
 	if err != nil {
+		metrics.IncHandshakeFailures(handshakeFailure(err))
 		log.Printf("Failed to handshake: %v", err)
+		conn.Close()
 		return
 	}
 	defer sshConn.Close()
+	conn.SetDeadline(time.Time{})
+	negotiated, ok := sniffer.negotiated()
+	if ok {
+		reportNegotiated(sshConn, negotiated)
+	}
 
-	go ssh.DiscardRequests(reqs)
+	timeouts := newConnTimeouts(sshConn, opts)
+	timeouts.start()
+	defer timeouts.stop()
+	if closes, err := k8s.CheckSchedule(sshConn.User(), time.Now()); err == nil && !closes.IsZero() {
+		timeouts.limit(closes, "access window closed")
+	}
 
-	restClient, err := rest.RESTClientFor(restConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gate, err := newApprovalGate(ctx, clientset, sshConn, timeouts, opts.ApprovalNamespace)
 	if err != nil {
-		log.Printf("Failed to create REST client: %v", err)
+		log.Printf("Access request for %s failed: %v", sshConn.User(), err)
 		return
 	}
 
+	forwards := newRemoteForwards(clientset, sshConn, opts.AdvertiseAddress)
+	defer forwards.closeAll()
+	keys := hostKeys.current()
+	if keys != nil {
+		keys.announce(sshConn)
+	}
+	go handleGlobalRequests(forwards, gate, keys, negotiated.HostKey, reqs)
+
+	restClient := clientset.CoreV1().RESTClient()
+
 	for newChannel := range chans {
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			log.Printf("Could not accept channel: %v", err)
-			continue
-		}
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				log.Printf("Could not accept channel: %v", err)
+				continue
+			}
 
-		go handleSSHRequests(clientset, restClient, restConfig, nil, channel, requests, sshConn.User())
+			go func() {
+				if err := gate.wait(channel); err != nil {
+					channel.Close()
+					return
+				}
+				release, err := sessions.acquire(sshConn.User(), opts)
+				if err != nil {
+					refuseSession(channel, sshConn.User(), err)
+					go ssh.DiscardRequests(requests)
+					return
+				}
+				defer release()
+				handleSSHRequests(clientset, restClient, restConfig, nil, timeouts.track(channel), requests, sshConn.User(), opts)
+			}()
+		case "direct-tcpip":
+			if err := gate.check(); err != nil {
+				newChannel.Reject(ssh.Prohibited, err.Error())
+				continue
+			}
+			release, err := sessions.acquire(sshConn.User(), opts)
+			if err != nil {
+				log.Printf("Refused port forward for %s: %v", sshConn.User(), err)
+				newChannel.Reject(ssh.ResourceShortage, err.Error())
+				continue
+			}
+			go func() {
+				defer release()
+				handleDirectTCPIP(clientset, restClient, restConfig, nil, newChannel, sshConn.User(), timeouts)
+			}()
+		default:
+			log.Printf("Unknown channel type: %s", newChannel.ChannelType())
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
 	}
 }
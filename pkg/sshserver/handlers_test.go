@@ -10,13 +10,17 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientFake "k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/rest/fake"
@@ -28,6 +32,7 @@ func initTestCache() {
 		"password":         "testpassword",
 		"publicKey":        "testpublickey",
 		"service":          "default",
+		"secretNamespace":  "default",
 		"podLabelSelector": "testpodlabelselector",
 		"containerName":    "testcontainer",
 		"shell":            "/bin/sh",
@@ -110,7 +115,7 @@ func TestHandleSSHRequests(t *testing.T) {
 		}
 		close(reqs)
 
-		handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser")
+		handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser", Options{})
 	})
 
 	t.Run("shell request", func(t *testing.T) {
@@ -121,7 +126,7 @@ func TestHandleSSHRequests(t *testing.T) {
 		}
 		close(reqs)
 
-		handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser")
+		handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser", Options{})
 	})
 
 	// t.Run("pty-req request", func(t *testing.T) {
@@ -134,7 +139,7 @@ func TestHandleSSHRequests(t *testing.T) {
 	// 	reqs <- &req.Request
 	// 	close(reqs)
 
-	// 	handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser")
+	// 	handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser", Options{})
 
 	// 	req.AssertExpectations(t)
 	// })
@@ -148,7 +153,7 @@ func TestHandleSSHRequests(t *testing.T) {
 	// 	}
 	// 	close(reqs)
 
-	// 	handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser")
+	// 	handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser", Options{})
 	// })
 
 	// t.Run("unknown request", func(t *testing.T) {
@@ -159,7 +164,7 @@ func TestHandleSSHRequests(t *testing.T) {
 	// 	}
 	// 	close(reqs)
 
-	// 	handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser")
+	// 	handleSSHRequests(clientset, restClient, config, executor, channel, reqs, "default-testuser", Options{})
 	// })
 }
 
@@ -233,7 +238,7 @@ func TestHandleSSHConnection(t *testing.T) {
 			channel, requests, err := newChannel.Accept()
 			require.NoError(t, err, "Failed to accept channel")
 
-			go handleSSHRequests(clientset, restClient, config, nil, channel, requests, sshConn.User())
+			go handleSSHRequests(clientset, restClient, config, nil, channel, requests, sshConn.User(), Options{})
 		}
 	}()
 
@@ -267,3 +272,89 @@ func TestHandleSSHConnection(t *testing.T) {
 
 	time.Sleep(1 * time.Second) // Give some time for the connection handling
 }
+
+func TestHandleSSHRequestsCommandRules(t *testing.T) {
+	k8s.SetSecretInCache("default-robot", map[string]string{
+		"service":          "default",
+		"secretNamespace":  "default",
+		"podLabelSelector": "app=db",
+		"containerName":    "postgres",
+		"allowCommands":    "./healthcheck\npg_dump *",
+	})
+	clientset := clientFake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default", Labels: map[string]string{"app": "db"}},
+	})
+	var mu sync.Mutex
+	streams := 0
+	executor := &mockExecutor{StreamFunc: func(options remotecommand.StreamOptions) error {
+		mu.Lock()
+		streams++
+		mu.Unlock()
+		return nil
+	}}
+
+	serverConn, chans, clientConn, _ := newTestConnPair(t, "default-robot")
+	go func() {
+		for newChannel := range chans {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go handleSSHRequests(clientset, &fake.RESTClient{}, &rest.Config{}, executor, channel, requests, serverConn.User(), Options{})
+		}
+	}()
+
+	// run sends a channel request and returns whether it was accepted, what
+	// was written to stderr and the exit status
+	run := func(request string, payload []byte) (bool, string, uint32) {
+		channel, requests, err := clientConn.OpenChannel("session", nil)
+		require.NoError(t, err)
+		status := make(chan uint32, 1)
+		go func() {
+			for req := range requests {
+				if req.Type == "exit-status" {
+					var exit exitStatus
+					ssh.Unmarshal(req.Payload, &exit)
+					status <- exit.Status
+				}
+			}
+			close(status)
+		}()
+
+		ok, err := channel.SendRequest(request, true, payload)
+		require.NoError(t, err)
+		stderr, _ := io.ReadAll(channel.Stderr())
+		io.ReadAll(channel)
+		return ok, string(stderr), <-status
+	}
+	command := func(command string) []byte {
+		return ssh.Marshal(struct{ Command string }{command})
+	}
+
+	ok, stderr, status := run("exec", command("bash -i"))
+	assert.False(t, ok)
+	assert.Contains(t, stderr, `command "bash -i" is not allowed`)
+	assert.Equal(t, uint32(1), status)
+
+	ok, stderr, _ = run("shell", nil)
+	assert.False(t, ok)
+	assert.Contains(t, stderr, "interactive shells are not allowed")
+
+	ok, stderr, _ = run("subsystem", command("sftp"))
+	assert.False(t, ok)
+	assert.Contains(t, stderr, "subsystems are not allowed")
+
+	mu.Lock()
+	assert.Zero(t, streams, "Refused commands must not reach the pod")
+	mu.Unlock()
+
+	channel, requests, err := clientConn.OpenChannel("session", nil)
+	require.NoError(t, err)
+	go ssh.DiscardRequests(requests)
+	_, err = channel.SendRequest("exec", false, command("pg_dump -Fc orders"))
+	require.NoError(t, err)
+	io.ReadAll(channel)
+	mu.Lock()
+	assert.Equal(t, 1, streams)
+	mu.Unlock()
+}
@@ -0,0 +1,188 @@
+package sshserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH host key rotation extensions (PROTOCOL 2.5): after authentication
+// the server announces all of its host keys, and clients that find new ones
+// ask the server to prove it holds them before adding them to known_hosts.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKeySet is the router's host keys in name order. The first key of each
+// algorithm is used for key exchange; every key is announced, so a new key
+// stored under a later name reaches known_hosts before the old one is removed.
+type hostKeySet struct {
+	signers []ssh.Signer
+}
+
+// parseHostKeys parses the PEM encoded private keys in data, keyed by name.
+func parseHostKeys(data map[string][]byte) (*hostKeySet, error) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := &hostKeySet{}
+	for _, name := range names {
+		signer, err := ssh.ParsePrivateKey(data[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse host key %s: %v", name, err)
+		}
+		keys.signers = append(keys.signers, signer)
+	}
+	if len(keys.signers) == 0 {
+		return nil, fmt.Errorf("no host keys")
+	}
+	return keys, nil
+}
+
+// serverConfig returns a copy of base serving the first key of each
+// algorithm, limited to the allowed host key algorithms. base must not have
+// host keys of its own.
+func (k *hostKeySet) serverConfig(base *ssh.ServerConfig, allowed []string) *ssh.ServerConfig {
+	config := *base
+	// AddHostKey replaces keys of the same algorithm, so add the first last
+	for i := len(k.signers) - 1; i >= 0; i-- {
+		if signer, ok := restrictHostKey(k.signers[i], allowed); ok {
+			config.AddHostKey(signer)
+		}
+	}
+	return &config
+}
+
+// usable counts the keys that can sign with one of the allowed host key
+// algorithms.
+func (k *hostKeySet) usable(allowed []string) int {
+	count := 0
+	for _, signer := range k.signers {
+		if _, ok := restrictHostKey(signer, allowed); ok {
+			count++
+		}
+	}
+	return count
+}
+
+// announce sends every host key to the client.
+func (k *hostKeySet) announce(conn ssh.Conn) {
+	var payload []byte
+	for _, signer := range k.signers {
+		payload = appendString(payload, signer.PublicKey().Marshal())
+	}
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		log.Printf("Failed to announce host keys to %s: %v", conn.User(), err)
+	}
+}
+
+// prove signs each key the client asked about over the session identifier,
+// proving the router holds the private halves. It fails if any is unknown.
+// RSA keys are signed with the connection's host key algorithm when it is an
+// RSA SHA-2 one, as OpenSSH verifies them with it.
+func (k *hostKeySet) prove(sessionID, payload []byte, hostKeyAlgorithm string) ([]byte, error) {
+	var reply []byte
+	for len(payload) > 0 {
+		var blob []byte
+		var ok bool
+		if blob, payload, ok = parseString(payload); !ok {
+			return nil, fmt.Errorf("malformed %s request", hostKeysProveRequest)
+		}
+		signer := k.find(blob)
+		if signer == nil {
+			return nil, fmt.Errorf("asked to prove an unknown host key")
+		}
+
+		data := appendString(nil, []byte(hostKeysProveRequest))
+		data = appendString(data, sessionID)
+		data = appendString(data, blob)
+		var signature *ssh.Signature
+		var err error
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, rsaProofAlgorithm(hostKeyAlgorithm))
+		} else {
+			signature, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign host key proof: %v", err)
+		}
+		reply = appendString(reply, ssh.Marshal(signature))
+	}
+	return reply, nil
+}
+
+// rsaProofAlgorithm returns the algorithm RSA proofs are signed with: the
+// negotiated one, or rsa-sha2-512 when it is not RSA SHA-2. Plain ssh-rsa
+// signatures use SHA-1, which current clients refuse.
+func rsaProofAlgorithm(hostKeyAlgorithm string) string {
+	if hostKeyAlgorithm == ssh.KeyAlgoRSASHA256 {
+		return ssh.KeyAlgoRSASHA256
+	}
+	return ssh.KeyAlgoRSASHA512
+}
+
+func (k *hostKeySet) find(blob []byte) ssh.Signer {
+	for _, signer := range k.signers {
+		if string(signer.PublicKey().Marshal()) == string(blob) {
+			return signer
+		}
+	}
+	return nil
+}
+
+// hostKeyStore holds the current host keys, replaced whenever the host key
+// Secret changes. Connections keep the keys they started with.
+type hostKeyStore struct {
+	mu   sync.RWMutex
+	keys *hostKeySet
+}
+
+// hostKeys is shared by every connection the router accepts.
+var hostKeys = &hostKeyStore{}
+
+// current returns the host keys, or nil before any were loaded.
+func (s *hostKeyStore) current() *hostKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+// load replaces the host keys with those in data, keeping the current ones
+// if data has none or any fail to parse.
+func (s *hostKeyStore) load(data map[string][]byte) error {
+	keys, err := parseHostKeys(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	return nil
+}
+
+// appendString appends an SSH wire format string (RFC 4251 5).
+func appendString(buf, s []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// parseString reads an SSH wire format string from the front of buf.
+func parseString(buf []byte) (s, rest []byte, ok bool) {
+	if len(buf) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(buf)
+	if uint64(len(buf)-4) < uint64(n) {
+		return nil, nil, false
+	}
+	return buf[4 : 4+n], buf[4+n:], true
+}
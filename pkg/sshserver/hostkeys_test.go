@@ -0,0 +1,198 @@
+package sshserver
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func hostKeyPEM(t *testing.T, key crypto.PrivateKey) []byte {
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	return pem.EncodeToMemory(block)
+}
+
+func testHostKeys(t *testing.T) map[string][]byte {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, nextEd25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return map[string][]byte{
+		"ssh_host_ed25519_key":      hostKeyPEM(t, ed25519Key),
+		"ssh_host_ed25519_key.next": hostKeyPEM(t, nextEd25519Key),
+		"ssh_host_ecdsa_key":        hostKeyPEM(t, ecdsaKey),
+		"ssh_host_rsa_key":          hostKeyPEM(t, rsaKey),
+	}
+}
+
+func TestParseHostKeys(t *testing.T) {
+	data := testHostKeys(t)
+	keys, err := parseHostKeys(data)
+	require.NoError(t, err)
+
+	var types []string
+	for _, signer := range keys.signers {
+		types = append(types, signer.PublicKey().Type())
+	}
+	assert.Equal(t, []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519, ssh.KeyAlgoED25519, ssh.KeyAlgoRSA}, types, "Keys are kept in name order")
+
+	_, err = parseHostKeys(map[string][]byte{})
+	assert.Error(t, err)
+	data["broken"] = []byte("not a key")
+	_, err = parseHostKeys(data)
+	assert.ErrorContains(t, err, "failed to parse host key broken")
+}
+
+func TestHostKeyStoreKeepsKeysOnError(t *testing.T) {
+	store := &hostKeyStore{}
+	assert.Nil(t, store.current())
+
+	require.NoError(t, store.load(testHostKeys(t)))
+	keys := store.current()
+	require.NotNil(t, keys)
+
+	assert.Error(t, store.load(map[string][]byte{"ssh_host_rsa_key": []byte("garbage")}))
+	assert.Same(t, keys, store.current(), "Invalid keys leave the current ones in place")
+}
+
+func TestHostKeySetServerConfig(t *testing.T) {
+	data := testHostKeys(t)
+	keys, err := parseHostKeys(data)
+	require.NoError(t, err)
+	served, err := ssh.ParsePrivateKey(data["ssh_host_ed25519_key"])
+	require.NoError(t, err)
+
+	for _, algorithm := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512} {
+		base := &ssh.ServerConfig{NoClientAuth: true}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if sshConn, _, _, err := ssh.NewServerConn(conn, keys.serverConfig(base, nil)); err == nil {
+				sshConn.Close()
+			}
+		}()
+
+		var hostKey ssh.PublicKey
+		client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			HostKeyAlgorithms: []string{algorithm},
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return nil
+			},
+		})
+		require.NoError(t, err, "%s is served", algorithm)
+		client.Close()
+		listener.Close()
+
+		if algorithm == ssh.KeyAlgoED25519 {
+			assert.Equal(t, served.PublicKey().Marshal(), hostKey.Marshal(), "The first key of an algorithm is served")
+		}
+	}
+}
+
+func TestHostKeySetAnnounceAndProve(t *testing.T) {
+	keys, err := parseHostKeys(testHostKeys(t))
+	require.NoError(t, err)
+	serverConn, _, _, clientReqs := newTestConnPair(t, "default-rotation")
+
+	keys.announce(serverConn)
+	req := <-clientReqs
+	require.Equal(t, hostKeysRequest, req.Type)
+	assert.False(t, req.WantReply)
+
+	var announced []ssh.PublicKey
+	for payload := req.Payload; len(payload) > 0; {
+		blob, rest, ok := parseString(payload)
+		require.True(t, ok)
+		key, err := ssh.ParsePublicKey(blob)
+		require.NoError(t, err)
+		announced = append(announced, key)
+		payload = rest
+	}
+	require.Len(t, announced, 4, "Every key is announced, including ones not served yet")
+
+	// The client asks for proof of the keys it has not seen before
+	var request []byte
+	for _, key := range announced[1:] {
+		request = appendString(request, key.Marshal())
+	}
+	proof, err := keys.prove(serverConn.SessionID(), request, ssh.KeyAlgoED25519)
+	require.NoError(t, err)
+
+	for _, key := range announced[1:] {
+		blob, rest, ok := parseString(proof)
+		require.True(t, ok)
+		proof = rest
+		signature := new(ssh.Signature)
+		require.NoError(t, ssh.Unmarshal(blob, signature))
+		if key.Type() == ssh.KeyAlgoRSA {
+			assert.Equal(t, ssh.KeyAlgoRSASHA512, signature.Format)
+		}
+
+		data := appendString(nil, []byte(hostKeysProveRequest))
+		data = appendString(data, serverConn.SessionID())
+		data = appendString(data, key.Marshal())
+		assert.NoError(t, key.Verify(data, signature), "%s proof verifies", key.Type())
+	}
+	assert.Empty(t, proof)
+
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, err := ssh.NewSignerFromKey(otherKey)
+	require.NoError(t, err)
+	_, err = keys.prove(serverConn.SessionID(), appendString(nil, other.PublicKey().Marshal()), ssh.KeyAlgoED25519)
+	assert.Error(t, err, "Unknown keys cannot be proved")
+	_, err = keys.prove(serverConn.SessionID(), []byte{0, 0, 1}, ssh.KeyAlgoED25519)
+	assert.Error(t, err)
+}
+
+func TestHostKeySetProveWithNegotiatedAlgorithm(t *testing.T) {
+	keys, err := parseHostKeys(testHostKeys(t))
+	require.NoError(t, err)
+	serverConn, _, _, _ := newTestConnPair(t, "default-rotation")
+	var rsaKey ssh.PublicKey
+	for _, signer := range keys.signers {
+		if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			rsaKey = signer.PublicKey()
+		}
+	}
+	require.NotNil(t, rsaKey)
+
+	for negotiated, expected := range map[string]string{
+		ssh.KeyAlgoRSASHA256: ssh.KeyAlgoRSASHA256,
+		ssh.KeyAlgoRSASHA512: ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSA:       ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoED25519:   ssh.KeyAlgoRSASHA512,
+	} {
+		proof, err := keys.prove(serverConn.SessionID(), appendString(nil, rsaKey.Marshal()), negotiated)
+		require.NoError(t, err)
+		blob, _, ok := parseString(proof)
+		require.True(t, ok)
+		signature := new(ssh.Signature)
+		require.NoError(t, ssh.Unmarshal(blob, signature))
+		assert.Equal(t, expected, signature.Format, "Proof on a %s connection", negotiated)
+
+		data := appendString(nil, []byte(hostKeysProveRequest))
+		data = appendString(data, serverConn.SessionID())
+		data = appendString(data, rsaKey.Marshal())
+		assert.NoError(t, rsaKey.Verify(data, signature))
+	}
+}
@@ -0,0 +1,179 @@
+package sshserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/metrics"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxKexInitBytes bounds how much of each direction is buffered while
+// looking for the key exchange init; a real one fits in a few kilobytes.
+const maxKexInitBytes = 64 * 1024
+
+// kexInit is SSH_MSG_KEXINIT (RFC 4253 7.1).
+type kexInit struct {
+	Cookie                  [16]byte `sshtype:"20"`
+	KexAlgos                []string
+	ServerHostKeyAlgos      []string
+	CiphersClientServer     []string
+	CiphersServerClient     []string
+	MACsClientServer        []string
+	MACsServerClient        []string
+	CompressionClientServer []string
+	CompressionServerClient []string
+	LanguagesClientServer   []string
+	LanguagesServerClient   []string
+	FirstKexFollows         bool
+	Reserved                uint32
+}
+
+// Negotiated are the algorithms a connection agreed on. MACs are empty
+// with AEAD ciphers, which authenticate on their own.
+type Negotiated struct {
+	KeyExchange string
+	HostKey     string
+	CipherIn    string
+	CipherOut   string
+	MACIn       string
+	MACOut      string
+}
+
+// kexSniffer reads the first key exchange init each side sends, which goes
+// out in clear text, so the negotiated algorithms can be reported;
+// golang.org/x/crypto/ssh does not expose them.
+type kexSniffer struct {
+	net.Conn
+	mu             sync.Mutex
+	client, server kexInitParser
+}
+
+func newKexSniffer(conn net.Conn) *kexSniffer {
+	return &kexSniffer{Conn: conn}
+}
+
+func (s *kexSniffer) Read(p []byte) (int, error) {
+	n, err := s.Conn.Read(p)
+	s.mu.Lock()
+	s.client.feed(p[:n])
+	s.mu.Unlock()
+	return n, err
+}
+
+func (s *kexSniffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	s.server.feed(p)
+	s.mu.Unlock()
+	return s.Conn.Write(p)
+}
+
+// negotiated applies the negotiation of RFC 4253 7.1 to the two key exchange
+// inits: the first algorithm of the client that the server also offers.
+func (s *kexSniffer) negotiated() (Negotiated, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, server := s.client.msg, s.server.msg
+	if client == nil || server == nil {
+		return Negotiated{}, false
+	}
+	n := Negotiated{
+		KeyExchange: firstCommon(client.KexAlgos, server.KexAlgos),
+		HostKey:     firstCommon(client.ServerHostKeyAlgos, server.ServerHostKeyAlgos),
+		CipherIn:    firstCommon(client.CiphersClientServer, server.CiphersClientServer),
+		CipherOut:   firstCommon(client.CiphersServerClient, server.CiphersServerClient),
+	}
+	if !aeadCipher(n.CipherIn) {
+		n.MACIn = firstCommon(client.MACsClientServer, server.MACsClientServer)
+	}
+	if !aeadCipher(n.CipherOut) {
+		n.MACOut = firstCommon(client.MACsServerClient, server.MACsServerClient)
+	}
+	return n, true
+}
+
+// reportNegotiated logs and counts the algorithms a connection uses.
+func reportNegotiated(conn ssh.ConnMetadata, n Negotiated) {
+	log.Printf("%s from %s (%s) negotiated kex=%s hostkey=%s cipher=%s/%s mac=%s/%s",
+		conn.User(), conn.RemoteAddr(), conn.ClientVersion(), n.KeyExchange, n.HostKey, n.CipherIn, n.CipherOut, n.MACIn, n.MACOut)
+	metrics.IncNegotiatedAlgorithm("kex", "", n.KeyExchange)
+	metrics.IncNegotiatedAlgorithm("hostkey", "", n.HostKey)
+	for _, direction := range []struct{ name, cipher, mac string }{
+		{"client_to_server", n.CipherIn, n.MACIn},
+		{"server_to_client", n.CipherOut, n.MACOut},
+	} {
+		metrics.IncNegotiatedAlgorithm("cipher", direction.name, direction.cipher)
+		if direction.mac != "" {
+			metrics.IncNegotiatedAlgorithm("mac", direction.name, direction.mac)
+		}
+	}
+}
+
+func firstCommon(client, server []string) string {
+	for _, algorithm := range client {
+		if contains(server, algorithm) {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+func aeadCipher(cipher string) bool {
+	return cipher == "aes128-gcm@openssh.com" || cipher == "aes256-gcm@openssh.com" || cipher == "chacha20-poly1305@openssh.com"
+}
+
+// kexInitParser skips the identification lines of one direction and parses
+// the binary packet that follows, which is the key exchange init.
+type kexInitParser struct {
+	buf        []byte
+	identified bool
+	done       bool
+	msg        *kexInit
+}
+
+func (p *kexInitParser) feed(data []byte) {
+	if p.done || len(data) == 0 {
+		return
+	}
+	p.buf = append(p.buf, data...)
+	if len(p.buf) > maxKexInitBytes {
+		p.done, p.buf = true, nil
+		return
+	}
+
+	// Servers may send other lines before the identification string, which
+	// starts with SSH-
+	for !p.identified {
+		end := bytes.IndexByte(p.buf, '\n')
+		if end < 0 {
+			return
+		}
+		p.identified = bytes.HasPrefix(p.buf, []byte("SSH-"))
+		p.buf = p.buf[end+1:]
+	}
+
+	if len(p.buf) < 5 {
+		return
+	}
+	length := binary.BigEndian.Uint32(p.buf)
+	if length < 1 || length > maxKexInitBytes {
+		p.done, p.buf = true, nil
+		return
+	}
+	if uint32(len(p.buf)-4) < length {
+		return
+	}
+	packet := p.buf[4 : 4+length]
+	p.done, p.buf = true, nil
+	padding := uint32(packet[0])
+	if padding+1 > length {
+		return
+	}
+	msg := &kexInit{}
+	if err := ssh.Unmarshal(packet[1:length-padding], msg); err == nil {
+		p.msg = msg
+	}
+}
@@ -0,0 +1,98 @@
+package sshserver
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/davidcollom/k8s-ssh-router/pkg/metrics"
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionLimits counts the session and direct-tcpip channels open on this
+// router per user, per target namespace and in total, so a runaway client
+// cannot open hundreds of exec or port-forward streams against the
+// apiserver. forwarded-tcpip channels are not counted: they carry
+// connections to the router's own listeners and never reach the apiserver.
+type sessionLimits struct {
+	mu         sync.Mutex
+	total      int
+	users      map[string]int
+	namespaces map[string]int
+}
+
+// sessions is shared by every connection the router serves.
+var sessions = newSessionLimits()
+
+func newSessionLimits() *sessionLimits {
+	return &sessionLimits{
+		users:      make(map[string]int),
+		namespaces: make(map[string]int),
+	}
+}
+
+// acquire reserves a session for username if no cap in opts, or the route's
+// maxSessions, has been reached. maxSessions can only lower
+// MaxSessionsPerUser. The returned func releases it. A zero cap is unlimited.
+func (s *sessionLimits) acquire(username string, opts Options) (func(), error) {
+	perUser := opts.MaxSessionsPerUser
+	namespace := ""
+	if secret, err := k8s.GetUserSecret(username); err == nil {
+		namespace = secret["service"]
+		if n, err := strconv.Atoi(secret["maxSessions"]); err == nil && n > 0 && (perUser == 0 || n < perUser) {
+			perUser = n
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case opts.MaxSessions > 0 && s.total >= opts.MaxSessions:
+		metrics.IncSessionsRejected("router")
+		return nil, fmt.Errorf("the router is at its limit of %d sessions, try again later", opts.MaxSessions)
+	case perUser > 0 && s.users[username] >= perUser:
+		metrics.IncSessionsRejected("user")
+		return nil, fmt.Errorf("%s already has %d open sessions, close one and try again", username, perUser)
+	case opts.MaxSessionsPerNamespace > 0 && s.namespaces[namespace] >= opts.MaxSessionsPerNamespace:
+		metrics.IncSessionsRejected("namespace")
+		return nil, fmt.Errorf("namespace %s already has %d open sessions, try again later", namespace, opts.MaxSessionsPerNamespace)
+	}
+
+	s.total++
+	s.users[username]++
+	s.namespaces[namespace]++
+	metrics.IncActiveSessions()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.total--
+			decrement(s.users, username)
+			decrement(s.namespaces, namespace)
+			metrics.DecActiveSessions()
+		})
+	}, nil
+}
+
+// decrement lowers a count, dropping it once it reaches zero so the maps do
+// not grow with every user ever seen.
+func decrement(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// refuseSession closes a session channel over a session limit, telling the
+// user why on stderr.
+func refuseSession(channel ssh.Channel, username string, err error) {
+	log.Printf("Refused session for %s: %v", username, err)
+	channel.Stderr().Write([]byte(err.Error() + "\n"))
+	channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: 1}))
+	channel.Close()
+}
@@ -0,0 +1,109 @@
+package sshserver
+
+import (
+	"testing"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSessionLimits(t *testing.T) {
+	k8s.SetSecretInCache("team-a-alice", map[string]string{"service": "team-a"})
+	k8s.SetSecretInCache("team-a-bob", map[string]string{"service": "team-a"})
+	k8s.SetSecretInCache("team-b-robot", map[string]string{"service": "team-b", "maxSessions": "1"})
+	limits := newSessionLimits()
+	opts := Options{MaxSessions: 5, MaxSessionsPerUser: 2, MaxSessionsPerNamespace: 3}
+
+	release1, err := limits.acquire("team-a-alice", opts)
+	require.NoError(t, err)
+	_, err = limits.acquire("team-a-alice", opts)
+	require.NoError(t, err)
+	_, err = limits.acquire("team-a-alice", opts)
+	assert.ErrorContains(t, err, "team-a-alice already has 2 open sessions")
+
+	_, err = limits.acquire("team-a-bob", opts)
+	require.NoError(t, err)
+	_, err = limits.acquire("team-a-bob", opts)
+	assert.ErrorContains(t, err, "namespace team-a already has 3 open sessions")
+
+	releaseRobot, err := limits.acquire("team-b-robot", opts)
+	require.NoError(t, err)
+	_, err = limits.acquire("team-b-robot", opts)
+	assert.ErrorContains(t, err, "team-b-robot already has 1 open sessions", "The route's maxSessions overrides the flag")
+
+	releaseRobot()
+	_, err = limits.acquire("team-b-robot", opts)
+	require.NoError(t, err)
+	_, err = limits.acquire("unknown-user", opts)
+	require.NoError(t, err)
+	_, err = limits.acquire("unknown-user", opts)
+	assert.ErrorContains(t, err, "the router is at its limit of 5 sessions")
+
+	// The router is full until a session ends
+	release1()
+	release1()
+	_, err = limits.acquire("team-a-bob", opts)
+	assert.NoError(t, err, "Releasing twice only frees one session")
+	assert.Equal(t, 5, limits.total)
+}
+
+func TestSessionLimitsRouteCannotRaise(t *testing.T) {
+	k8s.SetSecretInCache("team-b-greedy", map[string]string{"service": "team-b", "maxSessions": "100"})
+	limits := newSessionLimits()
+
+	for i := 0; i < 2; i++ {
+		_, err := limits.acquire("team-b-greedy", Options{MaxSessionsPerUser: 2})
+		require.NoError(t, err)
+	}
+	_, err := limits.acquire("team-b-greedy", Options{MaxSessionsPerUser: 2})
+	assert.ErrorContains(t, err, "team-b-greedy already has 2 open sessions", "The route's maxSessions cannot lift the flag")
+	_, err = limits.acquire("team-b-greedy", Options{})
+	assert.NoError(t, err, "Without a router cap the route's applies")
+}
+
+func TestSessionLimitsUnlimited(t *testing.T) {
+	limits := newSessionLimits()
+	var releases []func()
+	for i := 0; i < 100; i++ {
+		release, err := limits.acquire("default-unlimited", Options{})
+		require.NoError(t, err)
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release()
+	}
+	assert.Zero(t, limits.total)
+	assert.Empty(t, limits.users, "Counts are dropped once they reach zero")
+	assert.Empty(t, limits.namespaces)
+}
+
+func TestRefuseSession(t *testing.T) {
+	_, serverChans, clientConn, _ := newTestConnPair(t, "default-limited")
+
+	go func() {
+		channel, requests, err := (<-serverChans).Accept()
+		require.NoError(t, err)
+		go ssh.DiscardRequests(requests)
+		refuseSession(channel, "default-limited", assert.AnError)
+	}()
+
+	channel, requests, err := clientConn.OpenChannel("session", nil)
+	require.NoError(t, err)
+	statuses := make(chan uint32, 1)
+	go func() {
+		for req := range requests {
+			if req.Type == "exit-status" {
+				var status exitStatus
+				ssh.Unmarshal(req.Payload, &status)
+				statuses <- status.Status
+			}
+		}
+	}()
+
+	stderr := make([]byte, 1024)
+	n, _ := channel.Stderr().Read(stderr)
+	assert.Equal(t, assert.AnError.Error()+"\n", string(stderr[:n]))
+	assert.Equal(t, uint32(1), <-statuses)
+}
@@ -0,0 +1,97 @@
+package sshserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/metrics"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// handshakeGuard limits connections that have not authenticated yet: how
+// often each client IP may connect and how many may be handshaking at once
+// across the router.
+type handshakeGuard struct {
+	mu              sync.Mutex
+	unauthenticated int
+	// limiters holds a rate limiter per client IP, dropped once the IP has
+	// been quiet for a while.
+	limiters *cache.Cache
+}
+
+// handshakes is shared by every connection the router accepts.
+var handshakes = newHandshakeGuard()
+
+func newHandshakeGuard() *handshakeGuard {
+	return &handshakeGuard{limiters: cache.New(10*time.Minute, 10*time.Minute)}
+}
+
+// admit reserves a handshake slot for a connection from addr, unless the
+// client IP is over opts.ConnectionsPerMinute or opts.MaxUnauthenticated
+// connections are already handshaking. The returned func releases the slot.
+func (g *handshakeGuard) admit(addr net.Addr, opts Options) (func(), error) {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if opts.ConnectionsPerMinute > 0 {
+		var limiter *rate.Limiter
+		if cached, found := g.limiters.Get(ip); found {
+			limiter = cached.(*rate.Limiter)
+		} else {
+			limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(opts.ConnectionsPerMinute)), opts.ConnectionsPerMinute)
+		}
+		g.limiters.Set(ip, limiter, cache.DefaultExpiration)
+		if !limiter.Allow() {
+			metrics.IncConnectionsRejected("rate_limit")
+			return nil, fmt.Errorf("%s exceeded %d connections per minute", ip, opts.ConnectionsPerMinute)
+		}
+	}
+	if opts.MaxUnauthenticated > 0 && g.unauthenticated >= opts.MaxUnauthenticated {
+		metrics.IncConnectionsRejected("unauthenticated_limit")
+		return nil, fmt.Errorf("%d connections are already authenticating", g.unauthenticated)
+	}
+
+	g.unauthenticated++
+	metrics.IncUnauthenticatedConnections()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.unauthenticated--
+			metrics.DecUnauthenticatedConnections()
+		})
+	}, nil
+}
+
+// handshakeFailure names why a handshake failed for the handshake failure
+// metric: timeout, no_common_algorithm, max_auth_tries, auth or error.
+func handshakeFailure(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	if strings.Contains(err.Error(), "no common algorithm") {
+		return "no_common_algorithm"
+	}
+	var authErr *ssh.ServerAuthError
+	if errors.As(err, &authErr) {
+		for _, e := range authErr.Errors {
+			if strings.Contains(e.Error(), "too many authentication failures") {
+				return "max_auth_tries"
+			}
+		}
+		return "auth"
+	}
+	return "error"
+}
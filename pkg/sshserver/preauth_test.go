@@ -0,0 +1,160 @@
+package sshserver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestHandshakeGuardRateLimit(t *testing.T) {
+	guard := newHandshakeGuard()
+	opts := Options{ConnectionsPerMinute: 3}
+	alice := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	bob := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}
+
+	for i := 0; i < 3; i++ {
+		release, err := guard.admit(&net.TCPAddr{IP: alice.IP, Port: alice.Port + i}, opts)
+		require.NoError(t, err, "Connection %d is within the burst", i)
+		release()
+	}
+	_, err := guard.admit(alice, opts)
+	assert.ErrorContains(t, err, "192.0.2.1 exceeded 3 connections per minute", "Limits apply per IP, not per port")
+
+	release, err := guard.admit(bob, opts)
+	assert.NoError(t, err, "Other clients are not limited")
+	release()
+}
+
+func TestHandshakeGuardUnauthenticatedLimit(t *testing.T) {
+	guard := newHandshakeGuard()
+	opts := Options{MaxUnauthenticated: 2}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+
+	first, err := guard.admit(addr, opts)
+	require.NoError(t, err)
+	_, err = guard.admit(addr, opts)
+	require.NoError(t, err)
+	_, err = guard.admit(addr, opts)
+	assert.ErrorContains(t, err, "2 connections are already authenticating")
+
+	first()
+	first()
+	_, err = guard.admit(addr, opts)
+	assert.NoError(t, err, "A slot frees up once a connection authenticates")
+	assert.Equal(t, 2, guard.unauthenticated)
+}
+
+// serveOnce runs HandleSSHConnection for the first connection to a loopback
+// listener and returns its address and a channel closed once it returns.
+func serveOnce(t *testing.T, serverConfig *ssh.ServerConfig, opts Options) (string, chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		HandleSSHConnection(conn, serverConfig, clientFake.NewSimpleClientset(), &rest.Config{Host: "http://localhost"}, opts)
+	}()
+	return listener.Addr().String(), done
+}
+
+func testServerConfig(t *testing.T) *ssh.ServerConfig {
+	privateBytes, err := generatePrivateKey()
+	require.NoError(t, err)
+	signer, err := ssh.ParsePrivateKey(privateBytes)
+	require.NoError(t, err)
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, fmt.Errorf("password mismatch")
+		},
+		MaxAuthTries: 2,
+	}
+	serverConfig.AddHostKey(signer)
+	return serverConfig
+}
+
+func TestHandleSSHConnectionHandshakeTimeout(t *testing.T) {
+	addr, done := serveOnce(t, testServerConfig(t), Options{HandshakeTimeout: 200 * time.Millisecond})
+
+	// A client that never speaks SSH is cut off at the deadline
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Silent connection was not closed")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestHandshakeFailure(t *testing.T) {
+	assert.Equal(t, "timeout", handshakeFailure(&net.OpError{Op: "read", Err: timeoutError{}}))
+	assert.Equal(t, "max_auth_tries", handshakeFailure(&ssh.ServerAuthError{Errors: []error{fmt.Errorf("ssh: disconnect, reason 2: too many authentication failures")}}))
+	assert.Equal(t, "auth", handshakeFailure(&ssh.ServerAuthError{Errors: []error{fmt.Errorf("password mismatch")}}))
+	assert.Equal(t, "no_common_algorithm", handshakeFailure(fmt.Errorf("ssh: no common algorithm for key exchange; client offered: [diffie-hellman-group1-sha1], server offered: [curve25519-sha256]")))
+	assert.Equal(t, "error", handshakeFailure(fmt.Errorf("ssh: overflow reading version string")))
+}
+
+func TestHandleSSHConnectionMaxAuthTries(t *testing.T) {
+	addr, done := serveOnce(t, testServerConfig(t), Options{HandshakeTimeout: 5 * time.Second})
+
+	attempts := 0
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User: "default-guesser",
+		Auth: []ssh.AuthMethod{ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			attempts++
+			return "guess", nil
+		}), 10)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.Error(t, err)
+	assert.Equal(t, 2, attempts, "The server disconnects after MaxAuthTries failures")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection was not closed")
+	}
+}
+
+func TestHandleSSHConnectionRejected(t *testing.T) {
+	handshakes = newHandshakeGuard()
+	defer func() { handshakes = newHandshakeGuard() }()
+	opts := Options{ConnectionsPerMinute: 1, HandshakeTimeout: 200 * time.Millisecond}
+
+	// The first connection uses up the client's budget
+	addr, done := serveOnce(t, testServerConfig(t), opts)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	conn.Close()
+	<-done
+
+	addr, done = serveOnce(t, testServerConfig(t), opts)
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Rate limited connection was not closed before the handshake timeout")
+	}
+}
@@ -0,0 +1,278 @@
+package sshserver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/kubernetes"
+)
+
+// remoteForwardRequest is the payload of tcpip-forward and cancel-tcpip-forward (RFC 4254 7.1).
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// remoteForwardReply is sent when the client asked for port 0 and the server picked one.
+type remoteForwardReply struct {
+	BindPort uint32
+}
+
+// forwardedTCPIPPayload is the extra data of a forwarded-tcpip channel open (RFC 4254 7.2).
+type forwardedTCPIPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+type remoteForward struct {
+	listener  net.Listener
+	namespace string
+	service   string
+}
+
+// remoteForwards tracks the listeners a single connection opened for `ssh -R`
+// and the Services publishing them inside the cluster.
+type remoteForwards struct {
+	sync.Mutex
+	clientset        kubernetes.Interface
+	conn             ssh.Conn
+	advertiseAddress string
+	forwards         map[string]*remoteForward
+}
+
+// liveSessions holds the session IDs of the router's open connections, so the
+// forwards they published are not taken over by another connection.
+var liveSessions = &sessionRegistry{ids: make(map[string]bool)}
+
+type sessionRegistry struct {
+	sync.Mutex
+	ids map[string]bool
+}
+
+func (r *sessionRegistry) set(id string, live bool) {
+	r.Lock()
+	defer r.Unlock()
+	if live {
+		r.ids[id] = true
+	} else {
+		delete(r.ids, id)
+	}
+}
+
+func (r *sessionRegistry) live(id string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.ids[id]
+}
+
+func newRemoteForwards(clientset kubernetes.Interface, conn ssh.Conn, advertiseAddress string) *remoteForwards {
+	f := &remoteForwards{
+		clientset:        clientset,
+		conn:             conn,
+		advertiseAddress: advertiseAddress,
+		forwards:         make(map[string]*remoteForward),
+	}
+	liveSessions.set(f.session(), true)
+	return f
+}
+
+// handleGlobalRequests answers connection level requests, serving remote
+// port forwarding once gate lets the connection through, proving host keys
+// with the negotiated hostKeyAlgorithm and refusing everything else.
+func handleGlobalRequests(forwards *remoteForwards, gate *approvalGate, keys *hostKeySet, hostKeyAlgorithm string, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			if err := gate.check(); err != nil {
+				log.Printf("Remote forward for %s refused: %v", forwards.conn.User(), err)
+				req.Reply(false, nil)
+				continue
+			}
+			port, err := forwards.add(req.Payload)
+			if err != nil {
+				log.Printf("Remote forward for %s refused: %v", forwards.conn.User(), err)
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, ssh.Marshal(remoteForwardReply{BindPort: port}))
+		case "cancel-tcpip-forward":
+			if err := forwards.cancel(req.Payload); err != nil {
+				log.Printf("Failed to cancel remote forward for %s: %v", forwards.conn.User(), err)
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+		case hostKeysProveRequest:
+			if keys == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			proof, err := keys.prove(forwards.conn.SessionID(), req.Payload, hostKeyAlgorithm)
+			if err != nil {
+				log.Printf("Host key proof for %s failed: %v", forwards.conn.User(), err)
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, proof)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// add listens on a router port for the requested forward and publishes it as
+// a Service named after the user in the route's namespace.
+func (f *remoteForwards) add(payload []byte) (uint32, error) {
+	var req remoteForwardRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return 0, fmt.Errorf("invalid tcpip-forward payload: %v", err)
+	}
+	if f.advertiseAddress == "" {
+		return 0, fmt.Errorf("remote forwarding is not enabled on this router")
+	}
+
+	username := f.conn.User()
+	secret, err := k8s.GetUserSecret(username)
+	if err != nil {
+		return 0, err
+	}
+	if err := k8s.CheckNamespace(secret, secret["service"]); err != nil {
+		return 0, err
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen for remote forward: %v", err)
+	}
+	targetPort := listener.Addr().(*net.TCPAddr).Port
+
+	bindPort := req.BindPort
+	if bindPort == 0 {
+		bindPort = uint32(targetPort)
+	}
+	if err := k8s.CheckRemoteForward(username, bindPort); err != nil {
+		listener.Close()
+		return 0, err
+	}
+
+	forward := &remoteForward{
+		listener:  listener,
+		namespace: secret["service"],
+		service:   k8s.ForwardServiceName(username, bindPort),
+	}
+	key := net.JoinHostPort(req.BindAddr, strconv.Itoa(int(req.BindPort)))
+
+	f.Lock()
+	if _, exists := f.forwards[key]; exists {
+		f.Unlock()
+		listener.Close()
+		return 0, fmt.Errorf("%s is already forwarded", key)
+	}
+	f.forwards[key] = forward
+	f.Unlock()
+
+	if err := k8s.PublishForward(f.clientset, forward.namespace, forward.service, username, f.session(), int32(bindPort), f.advertiseAddress, int32(targetPort), liveSessions.live); err != nil {
+		f.remove(key)
+		return 0, err
+	}
+	log.Printf("Published remote forward %s/%s:%d for %s", forward.namespace, forward.service, bindPort, username)
+
+	go f.serve(forward, req.BindAddr, bindPort)
+	return bindPort, nil
+}
+
+// serve opens a forwarded-tcpip channel back to the client for every
+// in-cluster connection accepted on the forward's listener.
+func (f *remoteForwards) serve(forward *remoteForward, bindAddr string, bindPort uint32) {
+	for {
+		conn, err := forward.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			origin := conn.RemoteAddr().(*net.TCPAddr)
+			channel, reqs, err := f.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(forwardedTCPIPPayload{
+				Addr:       bindAddr,
+				Port:       bindPort,
+				OriginAddr: origin.IP.String(),
+				OriginPort: uint32(origin.Port),
+			}))
+			if err != nil {
+				log.Printf("Failed to open forwarded-tcpip channel: %v", err)
+				return
+			}
+			defer channel.Close()
+			go ssh.DiscardRequests(reqs)
+
+			done := make(chan struct{})
+			go func() {
+				io.Copy(conn, channel)
+				close(done)
+			}()
+			io.Copy(channel, conn)
+			channel.CloseWrite()
+			<-done
+		}()
+	}
+}
+
+func (f *remoteForwards) cancel(payload []byte) error {
+	var req remoteForwardRequest
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("invalid cancel-tcpip-forward payload: %v", err)
+	}
+	key := net.JoinHostPort(req.BindAddr, strconv.Itoa(int(req.BindPort)))
+	if !f.remove(key) {
+		return fmt.Errorf("%s is not forwarded", key)
+	}
+	return nil
+}
+
+// remove stops the forward registered under key and deletes its Service.
+func (f *remoteForwards) remove(key string) bool {
+	f.Lock()
+	forward, ok := f.forwards[key]
+	delete(f.forwards, key)
+	f.Unlock()
+	if !ok {
+		return false
+	}
+
+	forward.listener.Close()
+	if err := k8s.UnpublishForward(f.clientset, forward.namespace, forward.service, f.session()); err != nil {
+		log.Printf("Failed to remove remote forward service: %v", err)
+	}
+	return true
+}
+
+// closeAll removes every forward, called when the SSH connection ends.
+func (f *remoteForwards) closeAll() {
+	defer liveSessions.set(f.session(), false)
+	f.Lock()
+	keys := make([]string, 0, len(f.forwards))
+	for key := range f.forwards {
+		keys = append(keys, key)
+	}
+	f.Unlock()
+
+	for _, key := range keys {
+		f.remove(key)
+	}
+}
+
+func (f *remoteForwards) session() string {
+	return hex.EncodeToString(f.conn.SessionID())
+}
@@ -0,0 +1,95 @@
+package sshserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestRemoteForward(t *testing.T) {
+	k8s.SetSecretInCache("default-remoteuser", map[string]string{
+		"service":            "default",
+		"secretNamespace":    "default",
+		"allowedRemotePorts": "8080",
+	})
+
+	privateBytes, err := generatePrivateKey()
+	require.NoError(t, err, "Failed to generate private key")
+	signer, err := ssh.ParsePrivateKey(privateBytes)
+	require.NoError(t, err, "Failed to parse private key")
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	clientset := clientFake.NewSimpleClientset()
+	config := &rest.Config{Host: "http://localhost"}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		HandleSSHConnection(conn, serverConfig, clientset, config, Options{AdvertiseAddress: "127.0.0.1"})
+	}()
+
+	client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "default-remoteuser",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err, "Failed to connect")
+
+	_, err = client.Listen("tcp", "0.0.0.0:9999")
+	assert.Error(t, err, "Ports outside allowedRemotePorts should be refused")
+
+	remote, err := client.Listen("tcp", "0.0.0.0:8080")
+	require.NoError(t, err, "Failed to request remote forward")
+
+	name := k8s.ForwardServiceName("default-remoteuser", 8080)
+	service, err := clientset.CoreV1().Services("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.NoError(t, err, "Forward should be published as a Service")
+	assert.Equal(t, int32(8080), service.Spec.Ports[0].Port)
+	endpoints, err := clientset.CoreV1().Endpoints("default").Get(context.TODO(), name, metav1.GetOptions{})
+	require.NoError(t, err, "Forward should be published as Endpoints")
+
+	// Play the in-cluster client by dialling the published endpoint
+	address := endpoints.Subsets[0].Addresses[0].IP
+	port := endpoints.Subsets[0].Ports[0].Port
+	go func() {
+		conn, err := remote.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(reply), "Data should round trip through the developer's machine")
+	conn.Close()
+
+	client.Close()
+	assert.Eventually(t, func() bool {
+		_, err := clientset.CoreV1().Services("default").Get(context.TODO(), name, metav1.GetOptions{})
+		return errors.IsNotFound(err)
+	}, 5*time.Second, 50*time.Millisecond, "Service should be removed when the session ends")
+}
@@ -0,0 +1,447 @@
+package sshserver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// scpCommand is a parsed `scp -t` (sink) or `scp -f` (source) invocation as
+// sent by the scp client in legacy (non-SFTP) mode.
+type scpCommand struct {
+	source        bool
+	recursive     bool
+	preserveTimes bool
+	targetIsDir   bool
+	path          string
+}
+
+// parseSCPCommand recognises the remote half of an scp transfer.
+func parseSCPCommand(command string) (*scpCommand, bool) {
+	args, err := splitShellWords(command)
+	if err != nil || len(args) < 2 || path.Base(args[0]) != "scp" {
+		return nil, false
+	}
+
+	cmd := &scpCommand{}
+	mode := false
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				mode = true
+			case 'f':
+				mode = true
+				cmd.source = true
+			case 'r':
+				cmd.recursive = true
+			case 'p':
+				cmd.preserveTimes = true
+			case 'd':
+				cmd.targetIsDir = true
+			case 'v':
+			default:
+				return nil, false
+			}
+		}
+	}
+	if !mode || len(args) != 1 {
+		return nil, false
+	}
+	cmd.path = args[0]
+	return cmd, true
+}
+
+// splitShellWords splits a command line the way a POSIX shell would for the
+// simple quoting scp clients use on remote paths.
+func splitShellWords(command string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\\' && i+1 < len(command):
+			i++
+			word.WriteByte(command[i])
+			inWord = true
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("\"\\$`", command[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(command[i])
+			}
+			if i >= len(command) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// handleSCP serves an scp transfer against the user's pod by translating the
+// SCP protocol into a tar stream, so only `sh` and `tar` are needed in the image.
+func handleSCP(clientset kubernetes.Interface, restClient rest.Interface, config *rest.Config, executor k8s.Executor, channel ssh.Channel, username string, cmd *scpCommand) error {
+	secret, err := k8s.GetUserSecret(username)
+	if err != nil {
+		return err
+	}
+	target, err := k8s.ResolveTarget(clientset, secret)
+	if err != nil {
+		return err
+	}
+	if err := k8s.CheckPodAccess(clientset, secret, target, k8s.PodExec); err != nil {
+		return err
+	}
+	if config, err = k8s.SessionConfig(config, secret); err != nil {
+		return err
+	}
+
+	if cmd.source {
+		return scpFromPod(restClient, executor, config, target, channel, cmd)
+	}
+	return scpToPod(restClient, executor, config, target, channel, cmd)
+}
+
+// scpToPod receives files from the client (`scp -t`) and extracts them with tar.
+func scpToPod(restClient rest.Interface, executor k8s.Executor, config *rest.Config, target k8s.Target, channel ssh.Channel, cmd *scpCommand) error {
+	// A target that is an existing directory receives entries under their own
+	// names; otherwise the single top-level entry is renamed to the target.
+	dir, rename := cmd.path, ""
+	probe := k8s.StreamInPod(restClient, executor, config, target, []string{"test", "-d", cmd.path}, nil, nil, nil)
+	if probe != nil {
+		if cmd.targetIsDir {
+			scpError(channel, fmt.Sprintf("%s: Not a directory", cmd.path))
+			return fmt.Errorf("scp target %s is not a directory", cmd.path)
+		}
+		dir, rename = path.Dir(cmd.path), path.Base(cmd.path)
+	}
+
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		err := k8s.StreamInPod(restClient, executor, config, target, []string{"tar", "-x", "-f", "-", "-C", dir}, pr, io.Discard, &stderr)
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		// Unblock the protocol side if tar exits early, failing it with tar's
+		// own error so the client learns why
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.CloseWithError(errors.New("tar exited"))
+		}
+		done <- err
+	}()
+
+	tw := tar.NewWriter(pw)
+	sinkErr := scpSink(channel, channel, tw, rename, cmd.preserveTimes)
+	if sinkErr == nil {
+		sinkErr = tw.Close()
+	}
+	pw.CloseWithError(sinkErr)
+
+	if err := <-done; err != nil {
+		// A failed tar explains whatever the sink ran into
+		sinkErr = err
+	}
+	if sinkErr != nil {
+		scpError(channel, sinkErr.Error())
+	}
+	return sinkErr
+}
+
+// scpFromPod sends files to the client (`scp -f`) from a tar stream of the path.
+func scpFromPod(restClient rest.Interface, executor k8s.Executor, config *rest.Config, target k8s.Target, channel ssh.Channel, cmd *scpCommand) error {
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	go func() {
+		err := k8s.StreamInPod(restClient, executor, config, target, []string{"tar", "-c", "-h", "-f", "-", "-C", path.Dir(cmd.path), path.Base(cmd.path)}, nil, pw, &stderr)
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	if err := scpSource(channel, channel, tar.NewReader(pr), cmd.recursive, cmd.preserveTimes); err != nil {
+		scpError(channel, err.Error())
+		return err
+	}
+	return nil
+}
+
+// scpSink reads the SCP protocol from in, acknowledging on out, and writes
+// the received files and directories to tw. A non-empty rename replaces the
+// name of the first top-level entry.
+func scpSink(in io.Reader, out io.Writer, tw *tar.Writer, rename string, preserveTimes bool) error {
+	r := bufio.NewReader(in)
+	var dirs []string
+	var mtime, atime time.Time
+
+	if err := scpAck(out); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if len(dirs) > 0 {
+				return fmt.Errorf("unexpected end of transfer")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("empty scp message")
+		}
+
+		switch line[0] {
+		case 'T':
+			var mtimeSec, mtimeUsec, atimeSec, atimeUsec int64
+			if _, err := fmt.Sscanf(line[1:], "%d %d %d %d", &mtimeSec, &mtimeUsec, &atimeSec, &atimeUsec); err != nil {
+				return fmt.Errorf("invalid scp time message %q", line)
+			}
+			mtime, atime = time.Unix(mtimeSec, mtimeUsec*1000), time.Unix(atimeSec, atimeUsec*1000)
+		case 'C', 'D':
+			mode, size, name, err := parseSCPEntry(line)
+			if err != nil {
+				return err
+			}
+			if len(dirs) == 0 && rename != "" {
+				name = rename
+				rename = ""
+			}
+			header := &tar.Header{
+				Name:    path.Join(append(dirs, name)...),
+				Mode:    int64(mode),
+				ModTime: time.Now(),
+			}
+			if preserveTimes && !mtime.IsZero() {
+				header.ModTime, header.AccessTime, header.Format = mtime, atime, tar.FormatPAX
+			}
+			mtime, atime = time.Time{}, time.Time{}
+
+			if line[0] == 'D' {
+				header.Typeflag = tar.TypeDir
+				header.Name += "/"
+				if err := tw.WriteHeader(header); err != nil {
+					return err
+				}
+				dirs = append(dirs, name)
+				break
+			}
+
+			header.Typeflag = tar.TypeReg
+			header.Size = size
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if err := scpAck(out); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(tw, r, size); err != nil {
+				return fmt.Errorf("failed to copy %s: %v", header.Name, err)
+			}
+			if err := readSCPStatus(r); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+		case '\x01', '\x02':
+			return fmt.Errorf("client error: %s", line[1:])
+		default:
+			return fmt.Errorf("unknown scp message %q", line)
+		}
+		if err := scpAck(out); err != nil {
+			return err
+		}
+	}
+}
+
+// scpSource emits the entries of tr using the SCP protocol on out, waiting
+// for the client's acknowledgements on in.
+func scpSource(in io.Reader, out io.Writer, tr *tar.Reader, recursive, preserveTimes bool) error {
+	r := bufio.NewReader(in)
+	var dirs []string
+
+	if err := readSCPStatus(r); err != nil {
+		return err
+	}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(path.Clean(header.Name), "/")
+		parent, base := path.Split(name)
+		parents := strings.Split(strings.Trim(parent, "/"), "/")
+		if parent == "" {
+			parents = nil
+		}
+
+		// Leave directories until we are back at this entry's parent
+		for len(dirs) > len(parents) || !equalPrefix(dirs, parents) {
+			if len(dirs) == 0 {
+				return fmt.Errorf("unexpected tar entry %s", header.Name)
+			}
+			if err := scpSend(out, r, "E\n"); err != nil {
+				return err
+			}
+			dirs = dirs[:len(dirs)-1]
+		}
+
+		if preserveTimes && (header.Typeflag == tar.TypeDir || header.Typeflag == tar.TypeReg) {
+			atime := header.AccessTime
+			if atime.IsZero() {
+				atime = header.ModTime
+			}
+			if err := scpSend(out, r, fmt.Sprintf("T%d 0 %d 0\n", header.ModTime.Unix(), atime.Unix())); err != nil {
+				return err
+			}
+		}
+
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if !recursive {
+				return fmt.Errorf("%s: not a regular file", name)
+			}
+			if err := scpSend(out, r, fmt.Sprintf("D%04o 0 %s\n", mode, base)); err != nil {
+				return err
+			}
+			dirs = append(dirs, base)
+		case tar.TypeReg:
+			if err := scpSend(out, r, fmt.Sprintf("C%04o %d %s\n", mode, header.Size, base)); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(out, tr, header.Size); err != nil {
+				return err
+			}
+			if err := scpSend(out, r, "\x00"); err != nil {
+				return err
+			}
+		default:
+			log.Printf("Skipping unsupported scp entry %s", header.Name)
+		}
+	}
+
+	for range dirs {
+		if err := scpSend(out, r, "E\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseSCPEntry(line string) (uint32, int64, string, error) {
+	fields := strings.SplitN(line[1:], " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid scp message %q", line)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid scp mode %q", fields[0])
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid scp size %q", fields[1])
+	}
+	name := fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", fmt.Errorf("invalid scp file name %q", name)
+	}
+	return uint32(mode), size, name, nil
+}
+
+func equalPrefix(dirs, parents []string) bool {
+	for i := range dirs {
+		if dirs[i] != parents[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// scpSend writes msg and waits for the client's acknowledgement.
+func scpSend(out io.Writer, r *bufio.Reader, msg string) error {
+	if _, err := io.WriteString(out, msg); err != nil {
+		return err
+	}
+	return readSCPStatus(r)
+}
+
+func scpAck(out io.Writer) error {
+	_, err := out.Write([]byte{0})
+	return err
+}
+
+// readSCPStatus reads a single status byte, returning the message of warnings and errors.
+func readSCPStatus(r *bufio.Reader) error {
+	status, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status == 0 {
+		return nil
+	}
+	msg, _ := r.ReadString('\n')
+	return fmt.Errorf("client error: %s", strings.TrimSpace(msg))
+}
+
+// scpError reports a fatal error to the scp client.
+func scpError(channel ssh.Channel, msg string) {
+	fmt.Fprintf(channel, "\x02scp: %s\n", msg)
+}
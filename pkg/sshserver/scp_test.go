@@ -0,0 +1,186 @@
+package sshserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/rest/fake"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func TestParseSCPCommand(t *testing.T) {
+	cmd, ok := parseSCPCommand("scp -t /tmp/")
+	require.True(t, ok)
+	assert.Equal(t, &scpCommand{path: "/tmp/"}, cmd)
+
+	cmd, ok = parseSCPCommand("scp -r -p -f -- '/var/log/my app'")
+	require.True(t, ok)
+	assert.Equal(t, &scpCommand{source: true, recursive: true, preserveTimes: true, path: "/var/log/my app"}, cmd)
+
+	cmd, ok = parseSCPCommand(`/usr/bin/scp -dt "/data/a \"b\""`)
+	require.True(t, ok)
+	assert.Equal(t, &scpCommand{targetIsDir: true, path: `/data/a "b"`}, cmd)
+
+	for _, command := range []string{"ls -l", "scp /tmp", "scp -t", "scp -x -t /tmp", "scp -t a b", "scp -t 'unterminated"} {
+		_, ok := parseSCPCommand(command)
+		assert.False(t, ok, "%q should not be treated as scp", command)
+	}
+}
+
+func readTar(t *testing.T, data []byte) map[string]string {
+	entries := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		entries[header.Name] = string(content)
+	}
+}
+
+func TestSCPSink(t *testing.T) {
+	client := "D0755 0 dir\n" +
+		"T1700000000 0 1700000000 0\n" +
+		"C0644 5 a.txt\nhello\x00" +
+		"E\n" +
+		"C0600 3 b\nabc\x00"
+
+	t.Run("into directory", func(t *testing.T) {
+		var acks, archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		require.NoError(t, scpSink(strings.NewReader(client), &acks, tw, "", true))
+		require.NoError(t, tw.Close())
+
+		assert.Equal(t, strings.Repeat("\x00", 8), acks.String(), "Every message and file should be acknowledged")
+		assert.Equal(t, map[string]string{"dir/": "", "dir/a.txt": "hello", "b": "abc"}, readTar(t, archive.Bytes()))
+
+		tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+		tr.Next()
+		header, err := tr.Next()
+		require.NoError(t, err)
+		assert.Equal(t, time.Unix(1700000000, 0), header.ModTime, "-p should preserve modification times")
+		assert.Equal(t, int64(0o644), header.Mode)
+	})
+
+	t.Run("renamed target", func(t *testing.T) {
+		var acks, archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		require.NoError(t, scpSink(strings.NewReader(client), &acks, tw, "renamed", false))
+		require.NoError(t, tw.Close())
+
+		assert.Equal(t, map[string]string{"renamed/": "", "renamed/a.txt": "hello", "b": "abc"}, readTar(t, archive.Bytes()))
+	})
+
+	t.Run("path traversal", func(t *testing.T) {
+		var acks bytes.Buffer
+		err := scpSink(strings.NewReader("C0644 1 ../evil\nx\x00"), &acks, tar.NewWriter(io.Discard), "", false)
+		assert.Error(t, err)
+	})
+}
+
+func TestSCPSource(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	modTime := time.Unix(1700000000, 0)
+	for _, entry := range []struct {
+		name    string
+		content string
+	}{
+		{"logs/", ""},
+		{"logs/a.log", "aaa"},
+		{"logs/sub/", ""},
+		{"logs/sub/b.log", "b"},
+	} {
+		header := &tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(entry.content)), Typeflag: tar.TypeReg, ModTime: modTime}
+		if strings.HasSuffix(entry.name, "/") {
+			header.Mode, header.Typeflag = 0o755, tar.TypeDir
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	acks := strings.NewReader(strings.Repeat("\x00", 32))
+
+	t.Run("recursive", func(t *testing.T) {
+		var out bytes.Buffer
+		err := scpSource(acks, &out, tar.NewReader(bytes.NewReader(archive.Bytes())), true, false)
+		require.NoError(t, err)
+		assert.Equal(t, "D0755 0 logs\n"+
+			"C0644 3 a.log\naaa\x00"+
+			"D0755 0 sub\n"+
+			"C0644 1 b.log\nb\x00"+
+			"E\n"+
+			"E\n", out.String())
+	})
+
+	t.Run("preserve times", func(t *testing.T) {
+		var out bytes.Buffer
+		acks := strings.NewReader(strings.Repeat("\x00", 32))
+		err := scpSource(acks, &out, tar.NewReader(bytes.NewReader(archive.Bytes())), true, true)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(out.String(), "T1700000000 0 1700000000 0\nD0755 0 logs\n"))
+	})
+
+	t.Run("directory without -r", func(t *testing.T) {
+		var out bytes.Buffer
+		acks := strings.NewReader(strings.Repeat("\x00", 32))
+		err := scpSource(acks, &out, tar.NewReader(bytes.NewReader(archive.Bytes())), false, false)
+		assert.ErrorContains(t, err, "not a regular file")
+	})
+
+	t.Run("client error", func(t *testing.T) {
+		var out bytes.Buffer
+		acks := strings.NewReader("\x00\x02scp: disk full\n")
+		err := scpSource(acks, &out, tar.NewReader(bytes.NewReader(archive.Bytes())), true, false)
+		assert.ErrorContains(t, err, "disk full")
+	})
+}
+
+// scpChannel plays the client of a transfer, sending in and recording what
+// the router writes back.
+type scpChannel struct {
+	ssh.Channel
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *scpChannel) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *scpChannel) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func TestSCPToPodReportsTarFailure(t *testing.T) {
+	calls := 0
+	executor := &mockExecutor{StreamFunc: func(options remotecommand.StreamOptions) error {
+		calls++
+		if calls == 1 {
+			// test -d: the target is a directory
+			return nil
+		}
+		fmt.Fprintln(options.Stderr, "tar: can't open 'a.txt': Permission denied")
+		return errors.New("command terminated with exit code 1")
+	}}
+	channel := &scpChannel{in: strings.NewReader("C0644 5 a.txt\nhello\x00")}
+	cmd := &scpCommand{path: "/data"}
+
+	err := scpToPod(&fake.RESTClient{}, executor, &rest.Config{}, k8s.Target{Namespace: "default", Pod: "test-pod"}, channel, cmd)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Permission denied")
+	assert.Contains(t, channel.out.String(), "\x02scp: command terminated with exit code 1: tar: can't open 'a.txt': Permission denied\n",
+		"The client should see why tar failed")
+}
@@ -1,10 +1,13 @@
 package sshserver
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/davidcollom/k8s-ssh-router/pkg/auth"
 	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
@@ -14,49 +17,125 @@ import (
 	"k8s.io/client-go/rest"
 )
 
-func RunServer(reconcileInterval, sshPort, metricsPort int, namespace, privateKeyPath string) {
+// Options configures the SSH router.
+type Options struct {
+	ReconcileInterval int
+	SSHPort           int
+	MetricsPort       int
+	Namespace         string
+	PrivateKeyPath    string
+	// HostKeySecret names a Secret, as namespace/name or a name in Namespace,
+	// whose entries are PEM private host keys. It replaces PrivateKeyPath and
+	// is watched, so keys can be rotated without a restart.
+	HostKeySecret string
+	// AdvertiseAddress is the router pod IP that remote forward Services point
+	// at. Remote forwarding is disabled when it is empty.
+	AdvertiseAddress string
+	// KeepaliveInterval is how often keepalive@openssh.com probes are sent;
+	// the connection is dropped after KeepaliveCountMax unanswered probes.
+	KeepaliveInterval time.Duration
+	KeepaliveCountMax int
+	// IdleTimeout disconnects sessions without client input for this long.
+	IdleTimeout time.Duration
+	// MaxSessionDuration is the absolute lifetime of a connection.
+	MaxSessionDuration time.Duration
+	// SFTPHelperImage runs the helper pods serving SFTP for volume routes.
+	SFTPHelperImage string
+	// MaxSessions, MaxSessionsPerUser and MaxSessionsPerNamespace cap the
+	// session channels open at once on the router, per user and per target
+	// namespace. Zero is unlimited.
+	MaxSessions             int
+	MaxSessionsPerUser      int
+	MaxSessionsPerNamespace int
+	// HandshakeTimeout bounds the SSH handshake including authentication.
+	HandshakeTimeout time.Duration
+	// MaxAuthTries is the number of failed authentication attempts allowed
+	// per connection.
+	MaxAuthTries int
+	// ConnectionsPerMinute limits how often each client IP may connect, and
+	// MaxUnauthenticated how many connections may be authenticating at once.
+	// Zero is unlimited.
+	ConnectionsPerMinute int
+	MaxUnauthenticated   int
+	// AlgorithmProfile names one of AlgorithmProfiles, "default" when empty.
+	// Non-empty algorithm lists replace those of the profile.
+	AlgorithmProfile    string
+	KeyExchanges        []string
+	Ciphers             []string
+	MACs                []string
+	HostKeyAlgorithms   []string
+	PublicKeyAlgorithms []string
+	// ApprovalNamespace holds the access requests of routes that require
+	// approval, out of reach of the users they gate. The namespace of the
+	// route's Secret is used when it is empty.
+	ApprovalNamespace string
+	// CrossNamespace lists source=target rules letting routes of user Secrets
+	// in the source namespace reach the target one; "*" matches any. Routes
+	// are otherwise confined to their Secret's namespace and pods that opt in.
+	CrossNamespace []string
+	// ImpersonationPrefixes limits the kubernetesUser and kubernetesGroups of
+	// routes to identities starting with one of them. system: identities are
+	// always refused.
+	ImpersonationPrefixes []string
+}
+
+func RunServer(opts Options, clientset kubernetes.Interface, config *rest.Config) {
+	policy, err := k8s.ParseNamespacePolicy(opts.CrossNamespace)
+	if err != nil {
+		log.Fatalf("Invalid cross-namespace policy: %v", err)
+	}
+	k8s.SetNamespacePolicy(policy)
+	k8s.SetImpersonationPrefixes(opts.ImpersonationPrefixes)
+
 	go func() {
 		readyCh := make(chan struct{})
-		if _, err := k8s.WatchSecretsClusterWide(reconcileInterval, namespace, readyCh); err != nil {
+		if _, err := k8s.WatchSecretsClusterWide(opts.ReconcileInterval, opts.Namespace, readyCh); err != nil {
 			log.Fatalf("Failed to start watcher: %v", err)
 		}
 	}()
-	go metrics.StartMetricsServer(metricsPort)
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		log.Fatalf("Failed to create in-cluster config: %v", err)
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatalf("Failed to create Kubernetes client: %v", err)
-	}
-	startSSHServer(sshPort, privateKeyPath, clientset, config)
+	go metrics.StartMetricsServer(opts.MetricsPort)
+	startSSHServer(opts, clientset, config)
 }
 
-func startSSHServer(port int, privateKeyPath string, clientset kubernetes.Interface, restConfig *rest.Config) {
+func startSSHServer(opts Options, clientset kubernetes.Interface, restConfig *rest.Config) {
 	sshConfig := &ssh.ServerConfig{
 		NoClientAuth:      false,
 		PasswordCallback:  auth.PasswordCallback,
 		PublicKeyCallback: auth.PublicKeyCallback,
+		MaxAuthTries:      opts.MaxAuthTries,
 	}
-
-	privateBytes, err := os.ReadFile(privateKeyPath)
+	algorithms, err := serverAlgorithms(opts)
 	if err != nil {
-		log.Fatalf("Failed to load private key from %s: %v", privateKeyPath, err)
+		log.Fatalf("Invalid SSH algorithms: %v", err)
 	}
+	algorithms.apply(sshConfig)
+	log.Printf("Offering SSH algorithms: %s", algorithms)
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
-		log.Fatalf("Failed to parse private key: %v", err)
+	if opts.HostKeySecret != "" {
+		namespace, name := hostKeySecretName(opts)
+		if err := k8s.WatchHostKeys(context.Background(), clientset, namespace, name, hostKeys.load); err != nil {
+			log.Fatalf("Failed to load host keys: %v", err)
+		}
+		log.Printf("Loaded host keys from %s/%s", namespace, name)
+	} else {
+		privateBytes, err := os.ReadFile(opts.PrivateKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load private key from %s: %v", opts.PrivateKeyPath, err)
+		}
+		if err := hostKeys.load(map[string][]byte{opts.PrivateKeyPath: privateBytes}); err != nil {
+			log.Fatalf("Failed to parse private key: %v", err)
+		}
 	}
 
-	sshConfig.AddHostKey(private)
+	if usable := hostKeys.current().usable(algorithms.HostKeyAlgorithms); usable == 0 {
+		log.Fatalf("None of the host keys can be used with host key algorithms %s", strings.Join(algorithms.HostKeyAlgorithms, ","))
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", opts.SSHPort))
 	if err != nil {
-		log.Fatalf("Failed to listen on port %d: %v", port, err)
+		log.Fatalf("Failed to listen on port %d: %v", opts.SSHPort, err)
 	}
-	log.Printf("Listening on 0.0.0.0:%d...", port)
+	log.Printf("Listening on 0.0.0.0:%d...", opts.SSHPort)
 
 	for {
 		conn, err := listener.Accept()
@@ -64,6 +143,15 @@ func startSSHServer(port int, privateKeyPath string, clientset kubernetes.Interf
 			log.Printf("Failed to accept incoming connection: %v", err)
 			continue
 		}
-		go HandleSSHConnection(conn, sshConfig, clientset, restConfig)
+		go HandleSSHConnection(conn, hostKeys.current().serverConfig(sshConfig, algorithms.HostKeyAlgorithms), clientset, restConfig, opts)
+	}
+}
+
+// hostKeySecretName splits HostKeySecret, which is either namespace/name or a
+// name in Namespace.
+func hostKeySecretName(opts Options) (namespace, name string) {
+	if namespace, name, ok := strings.Cut(opts.HostKeySecret, "/"); ok {
+		return namespace, name
 	}
+	return opts.Namespace, opts.HostKeySecret
 }
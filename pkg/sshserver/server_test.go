@@ -64,7 +64,7 @@ func TestStartSSHServer(t *testing.T) {
 			channel, requests, err := newChannel.Accept()
 			require.NoError(t, err, "Failed to accept channel")
 
-			go handleSSHRequests(clientset, restClient, config, nil, channel, requests, sshConn.User())
+			go handleSSHRequests(clientset, restClient, config, nil, channel, requests, sshConn.User(), Options{})
 		}
 	}()
 
@@ -3,42 +3,184 @@ package sshserver
 import (
 	"io"
 	"log"
+	"strings"
 
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
-// handleSFTP handles SFTP requests.
-func handleSFTP(channel ssh.Channel, clientset kubernetes.Interface, config *rest.Config, namespace, podName, containerName string) {
-	server, err := sftp.NewServer(channel)
+// newSFTPHandler resolves the user's pods the same way shells are routed.
+// A route reaching several containers is served by an sftpDispatcher, and a
+// route naming a PersistentVolumeClaim by a helper pod mounting it. Routes in
+// config and logs mode get ConfigMaps and Secrets or container logs instead
+// of a container. release frees whatever the session needed once it ends.
+func newSFTPHandler(clientset kubernetes.Interface, restClient rest.Interface, config *rest.Config, newExecutor k8s.ExecutorFactory, username, helperImage string) (fs sftpFS, release func(), err error) {
+	secret, err := k8s.GetUserSecret(username)
 	if err != nil {
-		log.Printf("Failed to create SFTP server: %v", err)
-		channel.Close()
-		return
+		return nil, nil, err
+	}
+	switch secret["sftpMode"] {
+	case "config":
+		client, err := k8s.ImpersonatedClientset(config, secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newConfigFS(client, secret), func() {}, nil
+	case "logs":
+		logClient, err := k8s.SessionClientset(clientset, config, secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newLogsFS(clientset, logClient, secret), func() {}, nil
+	}
+	if config, err = k8s.SessionConfig(config, secret); err != nil {
+		return nil, nil, err
+	}
+	readOnly := secret["sftpReadOnly"] == "true"
+	roots := splitList(secret["sftpRoots"])
+
+	release = func() {}
+	var targets []k8s.Target
+	if claim := secret["pvc"]; claim != "" {
+		// The router creates the helper pod, so it cannot opt in to other namespaces
+		if err := k8s.CheckNamespace(secret, secret["service"]); err != nil {
+			return nil, nil, err
+		}
+		// The helper pod does not exist yet, so the user needs exec on any pod
+		if err := k8s.CheckPodAccess(clientset, secret, k8s.Target{Namespace: secret["service"]}, k8s.PodExec); err != nil {
+			return nil, nil, err
+		}
+		target, err := k8s.StartVolumeHelper(clientset, secret["service"], claim, helperImage, username, readOnly)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Started helper pod %s/%s for claim %s", target.Namespace, target.Pod, claim)
+		release = func() {
+			if err := k8s.StopVolumeHelper(clientset, target); err != nil {
+				log.Printf("Failed to remove helper pod: %v", err)
+			}
+		}
+		targets = []k8s.Target{target}
+		if len(roots) == 0 {
+			roots = []string{k8s.VolumeMountPath}
+		}
+	} else if targets, err = allowedTargets(clientset, secret); err != nil {
+		return nil, nil, err
+	}
+
+	newHandler := func(target k8s.Target) *SFTPHandler {
+		handler := &SFTPHandler{
+			Clientset:     clientset,
+			RESTClient:    restClient,
+			Config:        config,
+			Namespace:     target.Namespace,
+			PodName:       target.Pod,
+			ContainerName: target.Container,
+			NewExecutor:   newExecutor,
+			ReadOnly:      readOnly,
+		}
+		if len(roots) > 0 {
+			handler.Roots = handler.resolveRoots(roots)
+		}
+		return handler
+	}
+	if len(targets) > 1 {
+		return newSFTPDispatcher(targets, newHandler), release, nil
+	}
+
+	handler := newHandler(targets[0])
+	if handler.Roots == nil {
+		// sftp-server cannot be confined to roots, so only unconfined
+		// sessions may use it
+		handler.NativeServer = handler.probeSFTPServer()
+	}
+	return handler, release, nil
+}
+
+// allowedTargets resolves the route's containers, keeping those in pods the
+// user may exec into.
+func allowedTargets(clientset kubernetes.Interface, secret map[string]string) ([]k8s.Target, error) {
+	targets, err := k8s.ResolveTargets(clientset, secret)
+	if err != nil {
+		return nil, err
 	}
+	var allowed []k8s.Target
+	var denial error
+	for _, target := range targets {
+		if err := k8s.CheckPodAccess(clientset, secret, k8s.Target{Namespace: target.Namespace, Pod: target.Pod}, k8s.PodExec); err != nil {
+			denial = err
+			continue
+		}
+		allowed = append(allowed, target)
+	}
+	if len(allowed) == 0 {
+		return nil, denial
+	}
+	return allowed, nil
+}
+
+// sftpServerPaths are where distributions install OpenSSH's sftp-server.
+var sftpServerPaths = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+	"/usr/lib/sftp-server",
+}
 
-	handler := &SFTPHandler{
-		Clientset:     clientset,
-		Config:        config,
-		Namespace:     namespace,
-		PodName:       podName,
-		ContainerName: containerName,
+// probeSFTPServer returns the path of an executable sftp-server in the
+// container, or "" when the session has to be emulated.
+func (h *SFTPHandler) probeSFTPServer() string {
+	probe := `for p in "$@"; do if [ -x "$p" ]; then echo "$p"; exit 0; fi; done; command -v sftp-server`
+	stdout, _, err := h.execInPod(append([]string{"/bin/sh", "-c", probe, "sh"}, sftpServerPaths...)...)
+	if err != nil {
+		return ""
 	}
+	return strings.TrimSpace(string(stdout))
+}
 
-	server.SetFileGet(handler)
-	server.SetFilePut(handler)
-	server.SetFileRemove(handler)
-	server.SetFileList(handler)
-	server.SetFileRename(handler)
-	server.SetFileChmod(handler)
+// splitList splits a comma separated route value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handleSFTP handles SFTP requests, piping the channel straight to the
+// container's own sftp-server when it has one.
+func handleSFTP(channel ssh.Channel, fs sftpFS) {
+	if handler, ok := fs.(*SFTPHandler); ok && handler.NativeServer != "" {
+		command := []string{handler.NativeServer}
+		if handler.ReadOnly {
+			command = append(command, "-R")
+		}
+		log.Printf("Using %s in %s/%s", handler.NativeServer, handler.Namespace, handler.PodName)
+		if err := handler.stream(command, channel, channel, channel.Stderr()); err != nil {
+			log.Printf("SFTP server completed with error: %v", err)
+		}
+		channel.Close()
+		return
+	}
+
+	server := sftp.NewRequestServer(channel, sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}, sftp.WithStartDirectory(fs.startDirectory()))
 
 	if err := server.Serve(); err == io.EOF {
 		server.Close()
 		log.Printf("SFTP client exited session.")
 	} else if err != nil {
 		log.Printf("SFTP server completed with error: %v", err)
-		channel.Close()
 	}
+	channel.Close()
 }
@@ -0,0 +1,507 @@
+package sshserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/sftp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// configObjectLimit is the most a ConfigMap or Secret may hold.
+const configObjectLimit = 1 << 20
+
+// configKinds are the directories of each namespace.
+var configKinds = []string{"configmaps", "secrets"}
+
+// configFS presents ConfigMaps and Secrets as /<namespace>/<kind>/<name>/<key>.
+// Every call is made with the user's impersonated client, so their RBAC
+// decides what they may see and change.
+type configFS struct {
+	client     kubernetes.Interface
+	namespaces []string
+	readOnly   bool
+}
+
+func newConfigFS(client kubernetes.Interface, secret map[string]string) *configFS {
+	return &configFS{
+		client:     client,
+		namespaces: configNamespaces(secret),
+		readOnly:   secret["sftpReadOnly"] == "true",
+	}
+}
+
+// configNamespaces returns the route's configNamespaces, or else its own
+// namespace. Namespaces are never discovered, which would cost a login one
+// access review per namespace in the cluster.
+func configNamespaces(secret map[string]string) []string {
+	if namespaces := splitList(secret["configNamespaces"]); len(namespaces) > 0 {
+		return namespaces
+	}
+	return []string{secret["service"]}
+}
+
+func (c *configFS) startDirectory() string {
+	return "/"
+}
+
+// configPath is a parsed path; depth counts its set fields.
+type configPath struct {
+	name                         string
+	namespace, kind, object, key string
+	depth                        int
+}
+
+func (c *configFS) parse(name string) (configPath, error) {
+	p := configPath{name: name}
+	clean := strings.Trim(path.Clean("/"+name), "/")
+	if clean == "" {
+		return p, nil
+	}
+	parts := strings.Split(clean, "/")
+	if len(parts) > 4 {
+		return p, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	p.depth = len(parts)
+	fields := []*string{&p.namespace, &p.kind, &p.object, &p.key}
+	for i, part := range parts {
+		*fields[i] = part
+	}
+
+	if !contains(c.namespaces, p.namespace) || (p.depth > 1 && !contains(configKinds, p.kind)) {
+		return p, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	return p, nil
+}
+
+func contains(list []string, item string) bool {
+	for _, entry := range list {
+		if entry == item {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the keys of the object p points into.
+func (c *configFS) get(p configPath) (map[string][]byte, time.Time, error) {
+	if p.kind == "secrets" {
+		secret, err := c.client.CoreV1().Secrets(p.namespace).Get(context.TODO(), p.object, metav1.GetOptions{})
+		if err != nil {
+			return nil, time.Time{}, configError("open", p.name, err)
+		}
+		return secret.Data, secret.CreationTimestamp.Time, nil
+	}
+	configMap, err := c.client.CoreV1().ConfigMaps(p.namespace).Get(context.TODO(), p.object, metav1.GetOptions{})
+	if err != nil {
+		return nil, time.Time{}, configError("open", p.name, err)
+	}
+	return configMapData(configMap), configMap.CreationTimestamp.Time, nil
+}
+
+// update applies mutate to the keys of the object p points into, retrying
+// when someone else changed it in the meantime.
+func (c *configFS) update(op string, p configPath, mutate func(data map[string][]byte) error) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if p.kind == "secrets" {
+			secret, err := c.client.CoreV1().Secrets(p.namespace).Get(context.TODO(), p.object, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if secret.Data == nil {
+				secret.Data = make(map[string][]byte)
+			}
+			if err := mutate(secret.Data); err != nil {
+				return err
+			}
+			_, err = c.client.CoreV1().Secrets(p.namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
+			return err
+		}
+
+		configMap, err := c.client.CoreV1().ConfigMaps(p.namespace).Get(context.TODO(), p.object, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		data := configMapData(configMap)
+		if err := mutate(data); err != nil {
+			return err
+		}
+		setConfigMapData(configMap, data)
+		_, err = c.client.CoreV1().ConfigMaps(p.namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		return err
+	})
+	return configError(op, p.name, err)
+}
+
+// configMapData merges a ConfigMap's text and binary keys.
+func configMapData(configMap *corev1.ConfigMap) map[string][]byte {
+	data := make(map[string][]byte, len(configMap.Data)+len(configMap.BinaryData))
+	for key, value := range configMap.Data {
+		data[key] = []byte(value)
+	}
+	for key, value := range configMap.BinaryData {
+		data[key] = value
+	}
+	return data
+}
+
+// setConfigMapData stores text values in Data and everything else in BinaryData.
+func setConfigMapData(configMap *corev1.ConfigMap, data map[string][]byte) {
+	configMap.Data = nil
+	configMap.BinaryData = nil
+	for key, value := range data {
+		if utf8.Valid(value) {
+			if configMap.Data == nil {
+				configMap.Data = make(map[string]string)
+			}
+			configMap.Data[key] = string(value)
+		} else {
+			if configMap.BinaryData == nil {
+				configMap.BinaryData = make(map[string][]byte)
+			}
+			configMap.BinaryData[key] = value
+		}
+	}
+}
+
+// configError maps API errors to the errno values SFTP clients understand.
+func configError(op, name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case apierrors.IsNotFound(err):
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return denied(op, name)
+	case apierrors.IsAlreadyExists(err):
+		return &os.PathError{Op: op, Path: name, Err: syscall.EEXIST}
+	case apierrors.IsInvalid(err), apierrors.IsRequestEntityTooLargeError(err):
+		return &os.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+	}
+	return err
+}
+
+func (c *configFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	p, err := c.parse(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if p.depth < 4 {
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.EISDIR}
+	}
+	data, _, err := c.get(p)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := data[p.key]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.ENOENT}
+	}
+	return bytes.NewReader(value), nil
+}
+
+// Filewrite buffers the upload and stores it as the key when the client
+// closes the file.
+func (c *configFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if c.readOnly {
+		return nil, denied("open", r.Filepath)
+	}
+	p, err := c.parse(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if p.depth < 4 {
+		return nil, denied("open", r.Filepath)
+	}
+	data, _, err := c.get(p)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &configWriter{fs: c, path: p}
+	if !r.Pflags().Trunc {
+		writer.buf = append(writer.buf, data[p.key]...)
+	}
+	return writer, nil
+}
+
+// configWriter collects an upload in memory.
+type configWriter struct {
+	fs   *configFS
+	path configPath
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *configWriter) WriteAt(b []byte, off int64) (int, error) {
+	end := off + int64(len(b))
+	if end > configObjectLimit {
+		return 0, &os.PathError{Op: "write", Path: w.path.name, Err: syscall.EFBIG}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end > int64(len(w.buf)) {
+		w.buf = append(w.buf, make([]byte, end-int64(len(w.buf)))...)
+	}
+	return copy(w.buf[off:], b), nil
+}
+
+func (w *configWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fs.update("write", w.path, func(data map[string][]byte) error {
+		data[w.path.key] = w.buf
+		return nil
+	})
+}
+
+func (c *configFS) Filecmd(r *sftp.Request) error {
+	if c.readOnly {
+		return denied(strings.ToLower(r.Method), r.Filepath)
+	}
+	p, err := c.parse(r.Filepath)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "Setstat":
+		// Modes and times are not stored; only a size change means anything
+		if p.depth < 4 || !r.AttrFlags().Size {
+			_, err := c.stat(p)
+			return err
+		}
+		size := int64(r.Attributes().Size)
+		if size > configObjectLimit {
+			return &os.PathError{Op: "truncate", Path: r.Filepath, Err: syscall.EFBIG}
+		}
+		return c.update("truncate", p, func(data map[string][]byte) error {
+			value, ok := data[p.key]
+			if !ok {
+				return &os.PathError{Op: "truncate", Path: r.Filepath, Err: syscall.ENOENT}
+			}
+			if size <= int64(len(value)) {
+				data[p.key] = value[:size]
+			} else {
+				data[p.key] = append(value, make([]byte, size-int64(len(value)))...)
+			}
+			return nil
+		})
+	case "Remove":
+		if p.depth < 4 {
+			return &os.PathError{Op: "remove", Path: r.Filepath, Err: syscall.EISDIR}
+		}
+		return c.update("remove", p, func(data map[string][]byte) error {
+			if _, ok := data[p.key]; !ok {
+				return &os.PathError{Op: "remove", Path: r.Filepath, Err: syscall.ENOENT}
+			}
+			delete(data, p.key)
+			return nil
+		})
+	case "Rename":
+		return c.rename(r, p, false)
+	case "Mkdir":
+		if p.depth != 3 {
+			return denied("mkdir", r.Filepath)
+		}
+		return c.create(p)
+	case "Rmdir":
+		if p.depth != 3 {
+			return denied("rmdir", r.Filepath)
+		}
+		return c.remove(p)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename is Rename replacing an existing key.
+func (c *configFS) PosixRename(r *sftp.Request) error {
+	if c.readOnly {
+		return denied("rename", r.Filepath)
+	}
+	p, err := c.parse(r.Filepath)
+	if err != nil {
+		return err
+	}
+	return c.rename(r, p, true)
+}
+
+// rename moves a key within its object. Moving keys between objects would
+// not be atomic, so it is left to the client to copy.
+func (c *configFS) rename(r *sftp.Request, p configPath, overwrite bool) error {
+	target, err := c.parse(r.Target)
+	if err != nil {
+		return err
+	}
+	if p.depth != 4 || target.depth != 4 {
+		return denied("rename", r.Filepath)
+	}
+	if target.namespace != p.namespace || target.kind != p.kind || target.object != p.object {
+		return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: syscall.EXDEV}
+	}
+	return c.update("rename", p, func(data map[string][]byte) error {
+		value, ok := data[p.key]
+		if !ok {
+			return &os.PathError{Op: "rename", Path: r.Filepath, Err: syscall.ENOENT}
+		}
+		if _, exists := data[target.key]; exists && !overwrite {
+			return &os.PathError{Op: "rename", Path: r.Target, Err: syscall.EEXIST}
+		}
+		delete(data, p.key)
+		data[target.key] = value
+		return nil
+	})
+}
+
+// create makes an empty ConfigMap or Secret.
+func (c *configFS) create(p configPath) error {
+	meta := metav1.ObjectMeta{Name: p.object, Namespace: p.namespace}
+	var err error
+	if p.kind == "secrets" {
+		_, err = c.client.CoreV1().Secrets(p.namespace).Create(context.TODO(), &corev1.Secret{ObjectMeta: meta}, metav1.CreateOptions{})
+	} else {
+		_, err = c.client.CoreV1().ConfigMaps(p.namespace).Create(context.TODO(), &corev1.ConfigMap{ObjectMeta: meta}, metav1.CreateOptions{})
+	}
+	return configError("mkdir", p.name, err)
+}
+
+// remove deletes a ConfigMap or Secret that no longer has any keys.
+func (c *configFS) remove(p configPath) error {
+	data, _, err := c.get(p)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		return &os.PathError{Op: "rmdir", Path: p.name, Err: syscall.ENOTEMPTY}
+	}
+	if p.kind == "secrets" {
+		err = c.client.CoreV1().Secrets(p.namespace).Delete(context.TODO(), p.object, metav1.DeleteOptions{})
+	} else {
+		err = c.client.CoreV1().ConfigMaps(p.namespace).Delete(context.TODO(), p.object, metav1.DeleteOptions{})
+	}
+	return configError("rmdir", p.name, err)
+}
+
+func (c *configFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := c.parse(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "Stat":
+		file, err := c.stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{file}, nil
+	case "List":
+		return c.list(p)
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (c *configFS) stat(p configPath) (os.FileInfo, error) {
+	if p.depth < 3 {
+		return c.dir(path.Base(path.Clean("/"+p.name)), time.Time{}), nil
+	}
+	data, created, err := c.get(p)
+	if err != nil {
+		return nil, err
+	}
+	if p.depth == 3 {
+		return c.dir(p.object, created), nil
+	}
+	value, ok := data[p.key]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: p.name, Err: syscall.ENOENT}
+	}
+	return c.file(p.kind, p.key, value, created), nil
+}
+
+func (c *configFS) list(p configPath) (sftp.ListerAt, error) {
+	var files listerAt
+	switch p.depth {
+	case 0:
+		for _, namespace := range c.namespaces {
+			files = append(files, c.dir(namespace, time.Time{}))
+		}
+	case 1:
+		for _, kind := range configKinds {
+			files = append(files, c.dir(kind, time.Time{}))
+		}
+	case 2:
+		if p.kind == "secrets" {
+			secrets, err := c.client.CoreV1().Secrets(p.namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, configError("readdir", p.name, err)
+			}
+			for _, secret := range secrets.Items {
+				files = append(files, c.dir(secret.Name, secret.CreationTimestamp.Time))
+			}
+		} else {
+			configMaps, err := c.client.CoreV1().ConfigMaps(p.namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, configError("readdir", p.name, err)
+			}
+			for _, configMap := range configMaps.Items {
+				files = append(files, c.dir(configMap.Name, configMap.CreationTimestamp.Time))
+			}
+		}
+	case 3:
+		data, created, err := c.get(p)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(data))
+		for key := range data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			files = append(files, c.file(p.kind, key, data[key], created))
+		}
+	default:
+		file, err := c.stat(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (c *configFS) dir(name string, modTime time.Time) os.FileInfo {
+	mode := os.ModeDir | 0o755
+	if c.readOnly {
+		mode = os.ModeDir | 0o555
+	}
+	return &fileInfo{name: name, mode: mode, modTime: modTime}
+}
+
+// file describes a key. Secret values are only readable by their owner.
+func (c *configFS) file(kind, key string, value []byte, modTime time.Time) os.FileInfo {
+	mode := os.FileMode(0o644)
+	if kind == "secrets" {
+		mode = 0o600
+	}
+	if c.readOnly {
+		mode &^= 0o222
+	}
+	return &fileInfo{name: key, size: int64(len(value)), mode: mode, modTime: modTime}
+}
@@ -0,0 +1,161 @@
+package sshserver
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newConfigClientset() *clientFake.Clientset {
+	return clientFake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "web"},
+			Data:       map[string]string{"nginx.conf": "worker_processes 1;\n"},
+			BinaryData: map[string][]byte{"favicon.ico": {0xff, 0x00}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: "web"},
+			Data:       map[string][]byte{"tls.key": []byte("private")},
+		},
+	)
+}
+
+func TestSFTPConfigFS(t *testing.T) {
+	clientset := newConfigClientset()
+	fs := newConfigFS(clientset, map[string]string{"configNamespaces": "web, jobs"})
+	client := createSFTPClient(t, startSFTPServer(t, writeTestKey(t), AppFS, fs))
+	defer client.Close()
+
+	names := func(name string) []string {
+		entries, err := client.ReadDir(name)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+	readFile := func(name string) string {
+		file, err := client.Open(name)
+		require.NoError(t, err)
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		return string(data)
+	}
+	writeFile := func(name, content string) {
+		file, err := client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		require.NoError(t, err)
+		_, err = file.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+
+	t.Run("list", func(t *testing.T) {
+		assert.Equal(t, []string{"jobs", "web"}, names("/"))
+		assert.Equal(t, []string{"configmaps", "secrets"}, names("/web"))
+		assert.Equal(t, []string{"nginx"}, names("/web/configmaps"))
+		assert.Equal(t, []string{"favicon.ico", "nginx.conf"}, names("/web/configmaps/nginx"))
+
+		info, err := client.Stat("/web/secrets/tls/tls.key")
+		require.NoError(t, err)
+		assert.Equal(t, int64(len("private")), info.Size())
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), "Secret keys are only readable by their owner")
+
+		_, err = client.Stat("/kube-system")
+		assert.True(t, os.IsNotExist(err), "Namespaces outside the route are hidden")
+	})
+
+	t.Run("read", func(t *testing.T) {
+		assert.Equal(t, "worker_processes 1;\n", readFile("/web/configmaps/nginx/nginx.conf"))
+		assert.Equal(t, "\xff\x00", readFile("/web/configmaps/nginx/favicon.ico"))
+		assert.Equal(t, "private", readFile("/web/secrets/tls/tls.key"))
+
+		_, err := client.Open("/web/configmaps/nginx/missing.conf")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("write", func(t *testing.T) {
+		writeFile("/web/configmaps/nginx/nginx.conf", "worker_processes 4;\n")
+		writeFile("/web/secrets/tls/tls.crt", "certificate")
+
+		configMap, err := clientset.CoreV1().ConfigMaps("web").Get(context.TODO(), "nginx", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "worker_processes 4;\n", configMap.Data["nginx.conf"])
+		assert.Equal(t, []byte{0xff, 0x00}, configMap.BinaryData["favicon.ico"], "Binary keys stay binary")
+
+		secret, err := clientset.CoreV1().Secrets("web").Get(context.TODO(), "tls", metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "certificate", string(secret.Data["tls.crt"]))
+
+		// Editors that set times after an upload must not fail
+		require.NoError(t, client.Chmod("/web/configmaps/nginx/nginx.conf", 0o644))
+	})
+
+	t.Run("rename and remove keys", func(t *testing.T) {
+		require.NoError(t, client.Rename("/web/secrets/tls/tls.crt", "/web/secrets/tls/ca.crt"))
+		assert.Equal(t, "certificate", readFile("/web/secrets/tls/ca.crt"))
+
+		err := client.Rename("/web/secrets/tls/ca.crt", "/web/configmaps/nginx/ca.crt")
+		assert.Error(t, err, "Keys cannot move between objects")
+
+		require.NoError(t, client.Remove("/web/secrets/tls/ca.crt"))
+		assert.Equal(t, []string{"tls.key"}, names("/web/secrets/tls"))
+	})
+
+	t.Run("create and delete objects", func(t *testing.T) {
+		require.NoError(t, client.Mkdir("/jobs/configmaps/cron"))
+		writeFile("/jobs/configmaps/cron/schedule", "0 * * * *")
+		assert.Equal(t, []string{"cron"}, names("/jobs/configmaps"))
+
+		assert.Error(t, client.RemoveDirectory("/jobs/configmaps/cron"), "Objects with keys are not empty")
+		require.NoError(t, client.Remove("/jobs/configmaps/cron/schedule"))
+		require.NoError(t, client.RemoveDirectory("/jobs/configmaps/cron"))
+		_, err := clientset.CoreV1().ConfigMaps("jobs").Get(context.TODO(), "cron", metav1.GetOptions{})
+		assert.True(t, apierrors.IsNotFound(err))
+
+		assert.Error(t, client.Mkdir("/jobs/volumes"), "Only objects can be created")
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		clientset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "tls", nil)
+		})
+		_, err := client.Open("/web/secrets/tls/tls.key")
+		assert.True(t, os.IsPermission(err), "RBAC denials should reach the client as permission denied, got %v", err)
+	})
+}
+
+func TestSFTPConfigFSReadOnly(t *testing.T) {
+	clientset := newConfigClientset()
+	fs := newConfigFS(clientset, map[string]string{"configNamespaces": "web", "sftpReadOnly": "true"})
+	client := createSFTPClient(t, startSFTPServer(t, writeTestKey(t), AppFS, fs))
+	defer client.Close()
+
+	_, err := client.OpenFile("/web/configmaps/nginx/nginx.conf", os.O_WRONLY|os.O_TRUNC)
+	assert.Error(t, err)
+	assert.Error(t, client.Mkdir("/web/configmaps/new"))
+
+	configMap, err := clientset.CoreV1().ConfigMaps("web").Get(context.TODO(), "nginx", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "worker_processes 1;\n", configMap.Data["nginx.conf"])
+}
+
+func TestConfigNamespaces(t *testing.T) {
+	assert.Equal(t, []string{"web", "jobs"}, configNamespaces(map[string]string{"service": "apps", "configNamespaces": "web, jobs"}))
+	assert.Equal(t, []string{"apps"}, configNamespaces(map[string]string{"service": "apps"}),
+		"Routes without configNamespaces get their own namespace")
+}
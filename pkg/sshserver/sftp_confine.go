@@ -0,0 +1,81 @@
+package sshserver
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// resolveRoots canonicalizes the configured roots inside the container.
+// Roots that cannot be resolved are dropped, never widened to the whole
+// filesystem.
+func (h *SFTPHandler) resolveRoots(roots []string) []string {
+	resolved := make([]string, 0, len(roots))
+	for _, root := range roots {
+		stdout, stderr, err := h.execInPod("readlink", "-f", "--", path.Join("/", root))
+		if err != nil {
+			log.Printf("Ignoring SFTP root %s: %v, stderr: %s", root, err, strings.TrimSpace(string(stderr)))
+			continue
+		}
+		resolved = append(resolved, strings.TrimSuffix(string(stdout), "\n"))
+	}
+	return resolved
+}
+
+// confine canonicalizes name inside the container, resolving `..` and
+// symlinks, and refuses paths outside the allowed roots. The final component
+// is only resolved when follow is set, so symlinks themselves can still be
+// listed, read and removed. When it is followed the resolved target is
+// returned, so a link swapped after the check cannot redirect the operation.
+func (h *SFTPHandler) confine(name string, follow bool) (string, error) {
+	if h.Roots == nil {
+		return name, nil
+	}
+	if strings.Contains(name, "\n") {
+		return "", denied("open", name)
+	}
+
+	dir, base := path.Split(path.Clean(name))
+	stdout, stderr, err := h.execInPod("/bin/sh", "-c", `readlink -f -- "$1" && { readlink -f -- "$2" || true; }`, "sh", dir, name)
+	if err != nil {
+		return "", execError("open", name, err, stderr)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(stdout), "\n"), "\n")
+	resolved := path.Join(lines[0], base)
+	if !h.allowed(resolved) {
+		return "", denied("open", name)
+	}
+	if follow && len(lines) > 1 {
+		if !h.allowed(lines[1]) {
+			return "", denied("open", name)
+		}
+		return lines[1], nil
+	}
+	return resolved, nil
+}
+
+// allowed reports whether the canonical path name lies within a root.
+func (h *SFTPHandler) allowed(name string) bool {
+	for _, root := range h.Roots {
+		if root == "/" || name == root || strings.HasPrefix(name, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// startDirectory is where relative paths, like a client's initial ".", start.
+func (h *SFTPHandler) startDirectory() string {
+	if len(h.Roots) > 0 {
+		return h.Roots[0]
+	}
+	return "/"
+}
+
+// denied reports a refused path as permission denied; the SFTP server only
+// maps errno values to SSH_FX_PERMISSION_DENIED.
+func denied(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EACCES}
+}
@@ -0,0 +1,257 @@
+package sshserver
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/pkg/sftp"
+)
+
+// sftpFS serves an SFTP session: an SFTPHandler for a single container, or an
+// sftpDispatcher spanning several.
+type sftpFS interface {
+	sftp.FileReader
+	sftp.FileWriter
+	sftp.FileCmder
+	sftp.FileLister
+	startDirectory() string
+}
+
+// sftpDispatcher presents every container a route reaches as a directory
+// /<pod>/<container> and forwards each operation to that container's
+// SFTPHandler, so one session can pull the same file from every replica.
+type sftpDispatcher struct {
+	pods       map[string][]string
+	targets    map[string]k8s.Target
+	newHandler func(k8s.Target) *SFTPHandler
+
+	mu       sync.Mutex
+	handlers map[string]*SFTPHandler
+}
+
+func newSFTPDispatcher(targets []k8s.Target, newHandler func(k8s.Target) *SFTPHandler) *sftpDispatcher {
+	d := &sftpDispatcher{
+		pods:       make(map[string][]string),
+		targets:    make(map[string]k8s.Target),
+		newHandler: newHandler,
+		handlers:   make(map[string]*SFTPHandler),
+	}
+	for _, target := range targets {
+		d.pods[target.Pod] = append(d.pods[target.Pod], target.Container)
+		d.targets[target.Pod+"/"+target.Container] = target
+	}
+	return d
+}
+
+func (d *sftpDispatcher) startDirectory() string {
+	return "/"
+}
+
+// route splits a virtual path into the handler of its container and the path
+// inside that container. Paths above the containers have no handler.
+func (d *sftpDispatcher) route(name string) (*SFTPHandler, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean("/"+name), "/"), "/", 3)
+	switch {
+	case parts[0] == "":
+		return nil, "", nil
+	case len(parts) == 1:
+		if _, ok := d.pods[parts[0]]; !ok {
+			return nil, "", &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+		}
+		return nil, "", nil
+	}
+
+	key := parts[0] + "/" + parts[1]
+	target, ok := d.targets[key]
+	if !ok {
+		return nil, "", &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+	inner := "/"
+	if len(parts) == 3 {
+		inner += parts[2]
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	handler, ok := d.handlers[key]
+	if !ok {
+		handler = d.newHandler(target)
+		d.handlers[key] = handler
+	}
+	return handler, inner, nil
+}
+
+// routeFile is route for operations that need a container.
+func (d *sftpDispatcher) routeFile(op, name string) (*SFTPHandler, string, error) {
+	handler, inner, err := d.route(name)
+	if err == nil && handler == nil {
+		err = &os.PathError{Op: op, Path: name, Err: syscall.EISDIR}
+	}
+	return handler, inner, err
+}
+
+// routeWrite is route for operations that modify the container. The
+// directories above the containers are read-only.
+func (d *sftpDispatcher) routeWrite(op, name string) (*SFTPHandler, string, error) {
+	handler, inner, err := d.route(name)
+	if handler == nil && strings.Count(strings.Trim(path.Clean("/"+name), "/"), "/") < 2 {
+		err = denied(op, name)
+	}
+	return handler, inner, err
+}
+
+// subRequest rewrites r for the container it was routed to.
+func subRequest(r *sftp.Request, name, target string) *sftp.Request {
+	sub := sftp.NewRequest(r.Method, name)
+	sub.Filepath = name
+	sub.Flags = r.Flags
+	sub.Attrs = r.Attrs
+	sub.Target = target
+	return sub
+}
+
+func (d *sftpDispatcher) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	handler, inner, err := d.routeFile("open", r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return handler.Fileread(subRequest(r, inner, ""))
+}
+
+func (d *sftpDispatcher) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	handler, inner, err := d.routeWrite("open", r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return handler.Filewrite(subRequest(r, inner, ""))
+}
+
+func (d *sftpDispatcher) Filecmd(r *sftp.Request) error {
+	if r.Method == "Symlink" {
+		// Filepath is the link's content and stays as given
+		handler, inner, err := d.routeWrite("symlink", r.Target)
+		if err != nil {
+			return err
+		}
+		return handler.Filecmd(subRequest(r, r.Filepath, inner))
+	}
+
+	handler, inner, err := d.routeWrite(strings.ToLower(r.Method), r.Filepath)
+	if err != nil {
+		return err
+	}
+	var target string
+	if r.Target != "" {
+		var targetHandler *SFTPHandler
+		if targetHandler, target, err = d.route(r.Target); err != nil {
+			return err
+		}
+		if targetHandler != handler {
+			return &os.LinkError{Op: strings.ToLower(r.Method), Old: r.Filepath, New: r.Target, Err: syscall.EXDEV}
+		}
+	}
+	return handler.Filecmd(subRequest(r, inner, target))
+}
+
+func (d *sftpDispatcher) PosixRename(r *sftp.Request) error {
+	handler, inner, err := d.routeWrite("rename", r.Filepath)
+	if err != nil {
+		return err
+	}
+	targetHandler, target, err := d.route(r.Target)
+	if err != nil {
+		return err
+	}
+	if targetHandler != handler {
+		return &os.LinkError{Op: "rename", Old: r.Filepath, New: r.Target, Err: syscall.EXDEV}
+	}
+	return handler.PosixRename(subRequest(r, inner, target))
+}
+
+func (d *sftpDispatcher) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	handler, inner, err := d.route(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if handler != nil {
+		return handler.Filelist(subRequest(r, inner, ""))
+	}
+
+	switch r.Method {
+	case "List":
+		return d.virtualList(r.Filepath), nil
+	case "Stat":
+		return listerAt{virtualDir(path.Base(r.Filepath))}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (d *sftpDispatcher) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	handler, inner, err := d.route(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if handler == nil {
+		return listerAt{virtualDir(path.Base(r.Filepath))}, nil
+	}
+	return handler.Lstat(subRequest(r, inner, ""))
+}
+
+func (d *sftpDispatcher) Readlink(name string) (string, error) {
+	handler, inner, err := d.route(name)
+	if err != nil {
+		return "", err
+	}
+	if handler == nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return handler.Readlink(inner)
+}
+
+// RealPath resolves paths inside their container and maps them back under
+// the container's directory.
+func (d *sftpDispatcher) RealPath(name string) (string, error) {
+	name = path.Clean("/" + name)
+	handler, inner, err := d.route(name)
+	if err != nil || handler == nil {
+		return name, nil
+	}
+	resolved, err := handler.RealPath(inner)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 3)
+	return path.Join("/", parts[0], parts[1], resolved), nil
+}
+
+// virtualList lists the pods at the root or the containers of a pod.
+func (d *sftpDispatcher) virtualList(name string) listerAt {
+	var names []string
+	if pod := strings.Trim(path.Clean("/"+name), "/"); pod != "" {
+		names = append(names, d.pods[pod]...)
+	} else {
+		for pod := range d.pods {
+			names = append(names, pod)
+		}
+	}
+	sort.Strings(names)
+
+	list := make(listerAt, 0, len(names))
+	for _, name := range names {
+		list = append(list, virtualDir(name))
+	}
+	return list
+}
+
+func virtualDir(name string) os.FileInfo {
+	if name == "/" || name == "." {
+		name = "/"
+	}
+	return &fileInfo{name: name, mode: os.ModeDir | 0o555}
+}
@@ -5,124 +5,469 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
 	"github.com/pkg/sftp"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
 )
 
+// statFormat is the machine readable `stat -c` format parsed by parseStatLine:
+// raw mode in hex, size, mtime, uid, gid and finally the name, which may
+// contain spaces.
+const statFormat = "%f %s %Y %u %g %n"
+
 type SFTPHandler struct {
 	Clientset     kubernetes.Interface
+	RESTClient    rest.Interface
 	Config        *rest.Config
 	Namespace     string
 	PodName       string
 	ContainerName string
+	// NewExecutor builds the executor for each command, defaulting to SPDY.
+	NewExecutor k8s.ExecutorFactory
+	// Roots are the canonical directories the session is confined to. Nil
+	// means unconfined; an empty list refuses every path.
+	Roots []string
+	// ReadOnly refuses every operation that would modify the container.
+	ReadOnly bool
+	// NativeServer is the container's sftp-server, used instead of emulating
+	// the protocol when set.
+	NativeServer string
 }
 
-func (h *SFTPHandler) FileGet(r *sftp.Request) (io.ReaderAt, error) {
-	cmd := fmt.Sprintf("cat %s", r.Filepath)
-	stdout, stderr, err := h.execInPod(cmd)
+// Fileread streams the file out of the container instead of buffering it, so
+// downloads of any size are served within sftpReadWindow of memory.
+func (h *SFTPHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	name, err := h.confine(r.Filepath, true)
 	if err != nil {
-		return nil, fmt.Errorf("error reading file: %v, stderr: %s", err, stderr)
+		return nil, err
+	}
+	// Opening the file up front reports missing or unreadable files on open
+	if _, stderr, err := h.execInPod("head", "-c", "0", "--", name); err != nil {
+		return nil, execError("open", name, err, stderr)
 	}
-	return bytes.NewReader(stdout), nil
+	return newStreamReader(h.readFrom(name), sftpReadWindow), nil
 }
 
-func (h *SFTPHandler) FilePut(r *sftp.Request) (io.WriterAt, error) {
-	cmd := fmt.Sprintf("cat > %s", r.Filepath)
-	stdin := new(bytes.Buffer)
-	writer := &sftpFileWriter{stdin: stdin, handler: h, cmd: cmd}
-	return writer, nil
+// readFrom returns a function streaming name from the given offset onwards.
+func (h *SFTPHandler) readFrom(name string) func(off int64) io.ReadCloser {
+	return func(off int64) io.ReadCloser {
+		command := []string{"cat", "--", name}
+		if off > 0 {
+			command = []string{"tail", "-c", "+" + strconv.FormatInt(off+1, 10), "--", name}
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			var stderr bytes.Buffer
+			err := h.stream(command, nil, pw, &stderr)
+			if err != nil {
+				err = execError("read", name, err, stderr.Bytes())
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr
+	}
 }
 
-func (h *SFTPHandler) FileRemove(r *sftp.Request) error {
-	cmd := fmt.Sprintf("rm %s", r.Filepath)
-	_, stderr, err := h.execInPod(cmd)
+// Filewrite streams the upload into the container as it arrives. Files are
+// created, or truncated when asked, on open. Writes land at their offset
+// without truncating the rest of the file, so uploads can be resumed and
+// files edited in place; append mode writes at the end.
+func (h *SFTPHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if h.ReadOnly {
+		return nil, denied("open", r.Filepath)
+	}
+	name, err := h.confine(r.Filepath, true)
 	if err != nil {
-		return fmt.Errorf("error removing file: %v, stderr: %s", err, stderr)
+		return nil, err
 	}
-	return nil
+
+	flags := r.Pflags()
+	open := `: >> "$1"`
+	if flags.Trunc {
+		open = `: > "$1"`
+	}
+	// Redirections need a shell; the path is passed as $1, never as script
+	if _, stderr, err := h.execInPod("/bin/sh", "-c", open, "sh", name); err != nil {
+		return nil, execError("open", name, err, stderr)
+	}
+
+	return newStreamWriter(func(off int64, stdin io.Reader) error {
+		// dd only moves the offset of stdout, which cat then writes from
+		script := `exec 1<>"$1" && dd if=/dev/null bs=1 seek="$2" count=0 conv=notrunc && cat`
+		if flags.Append {
+			script = `cat >> "$1"`
+		}
+		var stderr bytes.Buffer
+		if err := h.stream([]string{"/bin/sh", "-c", script, "sh", name, strconv.FormatInt(off, 10)}, stdin, io.Discard, &stderr); err != nil {
+			return execError("write", name, err, stderr.Bytes())
+		}
+		return nil
+	}, sftpWriteWindow), nil
+}
+
+func (h *SFTPHandler) Filecmd(r *sftp.Request) error {
+	if h.ReadOnly {
+		return denied(strings.ToLower(r.Method), r.Filepath)
+	}
+	// A symlink's Filepath is the link's content, stored as given; following
+	// the link later is confined like any other path
+	name := r.Filepath
+	if r.Method != "Symlink" {
+		var err error
+		if name, err = h.confine(r.Filepath, r.Method == "Setstat" || r.Method == "Link"); err != nil {
+			return err
+		}
+	}
+	target := r.Target
+	if target != "" {
+		var err error
+		if target, err = h.confine(r.Target, false); err != nil {
+			return err
+		}
+	}
+
+	switch r.Method {
+	case "Remove":
+		return h.run("remove", name, "rm", "--", name)
+	case "Rename":
+		return h.run("rename", name, "mv", "--", name, target)
+	case "Setstat":
+		return h.fileSetstat(name, r)
+	case "Mkdir":
+		return h.run("mkdir", name, "mkdir", "--", name)
+	case "Rmdir":
+		return h.run("rmdir", name, "rmdir", "--", name)
+	case "Symlink":
+		return h.run("symlink", target, "ln", "-s", "--", name, target)
+	case "Link":
+		return h.run("link", target, "ln", "--", name, target)
+	}
+	return sftp.ErrSSHFxOpUnsupported
 }
 
-func (h *SFTPHandler) FileList(r *sftp.Request) ([]os.FileInfo, error) {
-	cmd := fmt.Sprintf("ls -l %s", r.Filepath)
-	stdout, stderr, err := h.execInPod(cmd)
+// PosixRename replaces an existing target, as posix-rename@openssh.com requires.
+func (h *SFTPHandler) PosixRename(r *sftp.Request) error {
+	if h.ReadOnly {
+		return denied("rename", r.Filepath)
+	}
+	name, err := h.confine(r.Filepath, false)
+	if err != nil {
+		return err
+	}
+	target, err := h.confine(r.Target, false)
 	if err != nil {
-		return nil, fmt.Errorf("error listing directory: %v, stderr: %s", err, stderr)
+		return err
+	}
+	return h.run("rename", name, "mv", "-f", "--", name, target)
+}
+
+func (h *SFTPHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		return h.fileList(r)
+	case "Stat":
+		return h.fileStat(r.Filepath, true)
 	}
-	// Parse stdout to create os.FileInfo slice
-	// ...
-	return nil, nil
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat reports symlinks themselves rather than their targets.
+func (h *SFTPHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	return h.fileStat(r.Filepath, false)
 }
 
-func (h *SFTPHandler) FileRename(r *sftp.Request) error {
-	cmd := fmt.Sprintf("mv %s %s", r.Filepath, r.Target)
-	_, stderr, err := h.execInPod(cmd)
+func (h *SFTPHandler) Readlink(name string) (string, error) {
+	name, err := h.confine(name, false)
 	if err != nil {
-		return fmt.Errorf("error renaming file: %v, stderr: %s", err, stderr)
+		return "", err
 	}
-	return nil
+	stdout, stderr, err := h.execInPod("readlink", "--", name)
+	if err != nil {
+		return "", execError("readlink", name, err, stderr)
+	}
+	return strings.TrimSuffix(string(stdout), "\n"), nil
+}
+
+// RealPath resolves symlinks inside the container. Paths that do not exist
+// yet, such as upload targets, are returned cleaned.
+func (h *SFTPHandler) RealPath(name string) (string, error) {
+	if !path.IsAbs(name) {
+		name = path.Join(h.startDirectory(), name)
+	}
+	name = path.Clean(name)
+	stdout, _, err := h.execInPod("readlink", "-f", "--", name)
+	if resolved := strings.TrimSuffix(string(stdout), "\n"); err == nil && resolved != "" {
+		name = resolved
+	}
+	if h.Roots != nil && !h.allowed(name) {
+		return "", denied("realpath", name)
+	}
+	return name, nil
 }
 
-func (h *SFTPHandler) FileChmod(r *sftp.Request) error {
-	cmd := fmt.Sprintf("chmod %o %s", r.Attributes().Permissions, r.Filepath)
-	_, stderr, err := h.execInPod(cmd)
+func (h *SFTPHandler) fileStat(name string, follow bool) (sftp.ListerAt, error) {
+	name, err := h.confine(name, follow)
+	if err != nil {
+		return nil, err
+	}
+	command := []string{"stat", "-c", statFormat, "--", name}
+	if follow {
+		command = []string{"stat", "-L", "-c", statFormat, "--", name}
+	}
+	stdout, stderr, err := h.execInPod(command...)
 	if err != nil {
-		return fmt.Errorf("error changing file permissions: %v, stderr: %s", err, stderr)
+		return nil, execError("stat", name, err, stderr)
+	}
+	files, err := parseStatOutput(stdout)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("unexpected stat output for %s", name)
+	}
+	files[0].name = path.Base(name)
+	return listerAt{files[0]}, nil
+}
+
+func (h *SFTPHandler) fileList(r *sftp.Request) (sftp.ListerAt, error) {
+	name, err := h.confine(r.Filepath, true)
+	if err != nil {
+		return nil, err
+	}
+	// Request paths are always absolute, so find cannot mistake them for options
+	stdout, stderr, err := h.execInPod("find", name+"/", "-mindepth", "1", "-maxdepth", "1", "-exec", "stat", "-c", statFormat, "{}", "+")
+	if err != nil {
+		return nil, execError("list", name, err, stderr)
+	}
+	files, err := parseStatOutput(stdout)
+	if err != nil {
+		return nil, err
+	}
+	list := make(listerAt, 0, len(files))
+	for _, file := range files {
+		file.name = path.Base(file.name)
+		list = append(list, file)
+	}
+	return list, nil
+}
+
+// fileSetstat applies each attribute the client sent: size, ownership, mode
+// and times, in that order so a chown cannot clear a freshly set setuid bit.
+func (h *SFTPHandler) fileSetstat(name string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		size := strconv.FormatUint(attrs.Size, 10)
+		if err := h.run("truncate", name, "truncate", "-s", size, "--", name); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		owner := fmt.Sprintf("%d:%d", attrs.UID, attrs.GID)
+		if err := h.run("chown", name, "chown", owner, "--", name); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		mode := strconv.FormatUint(uint64(attrs.Mode&0o7777), 8)
+		if err := h.run("chmod", name, "chmod", mode, "--", name); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		mtime := fmt.Sprintf("@%d", attrs.Mtime)
+		if attrs.Atime == attrs.Mtime {
+			return h.run("touch", name, "touch", "-c", "-d", mtime, "--", name)
+		}
+		if err := h.run("touch", name, "touch", "-c", "-m", "-d", mtime, "--", name); err != nil {
+			return err
+		}
+		atime := fmt.Sprintf("@%d", attrs.Atime)
+		return h.run("touch", name, "touch", "-c", "-a", "-d", atime, "--", name)
 	}
 	return nil
 }
 
-func (h *SFTPHandler) execInPod(cmd string) ([]byte, []byte, error) {
-	req := h.Clientset.CoreV1().RESTClient().Post().
+// run executes a command that only reports success or failure.
+func (h *SFTPHandler) run(op, name string, command ...string) error {
+	if _, stderr, err := h.execInPod(command...); err != nil {
+		return execError(op, name, err, stderr)
+	}
+	return nil
+}
+
+// execInPod runs command as an argument vector, never through a shell, so
+// client supplied paths cannot inject commands.
+func (h *SFTPHandler) execInPod(command ...string) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	if err := h.stream(command, nil, &stdout, &stderr); err != nil {
+		return nil, stderr.Bytes(), err
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// stream runs command in the container, wiring up the given streams. A nil
+// stream is not requested from the API server.
+func (h *SFTPHandler) stream(command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	req := h.RESTClient.Post().
 		Resource("pods").
 		Name(h.PodName).
 		Namespace(h.Namespace).
 		SubResource("exec").
 		Param("container", h.ContainerName).
-		Param("command", "/bin/sh").
-		Param("command", "-c").
-		Param("command", cmd).
-		Param("stdin", "true").
-		Param("stdout", "true").
-		Param("stderr", "true").
+		Param("stdin", strconv.FormatBool(stdin != nil)).
+		Param("stdout", strconv.FormatBool(stdout != nil)).
+		Param("stderr", strconv.FormatBool(stderr != nil)).
 		Param("tty", "false")
+	for _, arg := range command {
+		req.Param("command", arg)
+	}
 
-	exec, err := remotecommand.NewSPDYExecutor(h.Config, "POST", req.URL())
+	newExecutor := h.NewExecutor
+	if newExecutor == nil {
+		newExecutor = k8s.NewSPDYExecutor
+	}
+	exec, err := newExecutor(h.Config, "POST", req.URL())
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	var stdout, stderr bytes.Buffer
-	err = exec.Stream(remotecommand.StreamOptions{
-		Stdin:  nil,
-		Stdout: &stdout,
-		Stderr: &stderr,
-		Tty:    false,
+	return exec.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
 	})
-	if err != nil {
-		return nil, nil, err
-	}
+}
 
-	return stdout.Bytes(), stderr.Bytes(), nil
+// execError turns a failed command into an error the SFTP client understands,
+// so missing files are reported as such rather than as generic failures.
+func execError(op, name string, err error, stderr []byte) error {
+	msg := strings.TrimSpace(string(stderr))
+	switch {
+	case strings.Contains(msg, "No such file"):
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case strings.Contains(msg, "Permission denied"):
+		return denied(op, name)
+	}
+	return fmt.Errorf("%s %s: %v, stderr: %s", op, name, err, msg)
 }
 
-type sftpFileWriter struct {
-	stdin   *bytes.Buffer
-	handler *SFTPHandler
-	cmd     string
+// fileInfo is an os.FileInfo built from `stat -c statFormat` output.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	uid     uint32
+	gid     uint32
 }
 
-func (w *sftpFileWriter) WriteAt(p []byte, off int64) (int, error) {
-	_, err := w.stdin.Write(p)
-	return len(p), err
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+func (fi *fileInfo) Uid() uint32        { return fi.uid }
+func (fi *fileInfo) Gid() uint32        { return fi.gid }
+
+// parseStatOutput parses one statFormat line per file.
+func parseStatOutput(output []byte) ([]*fileInfo, error) {
+	var files []*fileInfo
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		file, err := parseStatLine(line)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
 }
 
-func (w *sftpFileWriter) Close() error {
-	_, stderr, err := w.handler.execInPod(w.cmd)
+func parseStatLine(line string) (*fileInfo, error) {
+	fields := strings.SplitN(line, " ", 6)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("unexpected stat output %q", line)
+	}
+	rawMode, err := strconv.ParseUint(fields[0], 16, 32)
 	if err != nil {
-		return fmt.Errorf("error writing file: %v, stderr: %s", err, stderr)
+		return nil, fmt.Errorf("unexpected stat mode %q", fields[0])
 	}
-	return nil
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected stat size %q", fields[1])
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected stat mtime %q", fields[2])
+	}
+	uid, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected stat uid %q", fields[3])
+	}
+	gid, err := strconv.ParseUint(fields[4], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected stat gid %q", fields[4])
+	}
+	return &fileInfo{
+		name:    fields[5],
+		size:    size,
+		mode:    fileModeFromUnix(uint32(rawMode)),
+		modTime: time.Unix(mtime, 0),
+		uid:     uint32(uid),
+		gid:     uint32(gid),
+	}, nil
+}
+
+// fileModeFromUnix converts a raw st_mode into an os.FileMode.
+func fileModeFromUnix(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0o777)
+	switch mode & 0o170000 {
+	case 0o040000:
+		fileMode |= os.ModeDir
+	case 0o120000:
+		fileMode |= os.ModeSymlink
+	case 0o010000:
+		fileMode |= os.ModeNamedPipe
+	case 0o140000:
+		fileMode |= os.ModeSocket
+	case 0o020000:
+		fileMode |= os.ModeDevice | os.ModeCharDevice
+	case 0o060000:
+		fileMode |= os.ModeDevice
+	}
+	if mode&0o4000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+// listerAt serves a fixed set of files to the SFTP request server.
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
 }
@@ -0,0 +1,188 @@
+package sshserver
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/pkg/sftp"
+	"k8s.io/client-go/kubernetes"
+)
+
+// logSizeLimit caps how much of a log is served, and held in memory while it
+// is being listed or downloaded.
+const logSizeLimit = 32 << 20
+
+// logSnapshotTTL is how long a log read for a listing or Stat is reused, so
+// the download that usually follows sees the same size without reading it
+// again.
+const logSnapshotTTL = 10 * time.Second
+
+// logSnapshot is a log as it was read at taken.
+type logSnapshot struct {
+	data  []byte
+	taken time.Time
+}
+
+// logsFS is a read-only tree of the logs of every container a route covers,
+// /logs/<pod>/<container>.log and <container>.previous.log, read through the
+// pod log API so neither exec nor cat is needed in the container. Pods are
+// resolved by the router; logs are read with logClient, which impersonates
+// the user when the route names one. Pods the user may not read the logs of
+// are left out.
+type logsFS struct {
+	clientset kubernetes.Interface
+	logClient kubernetes.Interface
+	secret    map[string]string
+
+	mu        sync.Mutex
+	snapshots map[string]logSnapshot
+}
+
+func newLogsFS(clientset, logClient kubernetes.Interface, secret map[string]string) *logsFS {
+	return &logsFS{clientset: clientset, logClient: logClient, secret: secret, snapshots: make(map[string]logSnapshot)}
+}
+
+func (l *logsFS) startDirectory() string {
+	return "/logs"
+}
+
+// logName is the file name of a container log.
+func logName(file k8s.LogFile) string {
+	if file.Previous {
+		return file.Container + ".previous.log"
+	}
+	return file.Container + ".log"
+}
+
+// lookup resolves name to the directory listing it stands for, or the log
+// it names. The pods are looked up on every call so restarts show up.
+func (l *logsFS) lookup(name string) (entries []os.FileInfo, file *k8s.LogFile, err error) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	if parts[0] == "" {
+		return []os.FileInfo{virtualDir("logs")}, nil, nil
+	}
+	if parts[0] != "logs" || len(parts) > 3 {
+		return nil, nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+
+	logs, err := k8s.ResolveLogs(l.clientset, l.secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	pods := make(map[string]bool)
+	readable := make(map[string]bool)
+	for i, entry := range logs {
+		allowed, checked := readable[entry.Pod]
+		if !checked {
+			allowed = k8s.CheckPodAccess(l.clientset, l.secret, entry.Target, k8s.PodLog) == nil
+			readable[entry.Pod] = allowed
+		}
+		if !allowed {
+			continue
+		}
+		switch {
+		case len(parts) == 1 && !pods[entry.Pod]:
+			entries = append(entries, virtualDir(entry.Pod))
+		case len(parts) == 2 && entry.Pod == parts[1]:
+			entries = append(entries, l.fileInfo(entry))
+		case len(parts) == 3 && entry.Pod == parts[1] && logName(entry) == parts[2]:
+			return nil, &logs[i], nil
+		}
+		pods[entry.Pod] = true
+	}
+
+	if len(parts) == 1 || (len(parts) == 2 && pods[parts[1]]) {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		return entries, nil, nil
+	}
+	return nil, nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+}
+
+// read returns the log, at most logSizeLimit bytes of it, reusing a read made
+// within logSnapshotTTL. The log API can only start from the beginning, so
+// the whole log is read once and every range served from memory.
+func (l *logsFS) read(file k8s.LogFile) ([]byte, error) {
+	key := path.Join(file.Namespace, file.Pod, logName(file))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, snapshot := range l.snapshots {
+		if time.Since(snapshot.taken) > logSnapshotTTL {
+			delete(l.snapshots, name)
+		}
+	}
+	if snapshot, ok := l.snapshots[key]; ok {
+		return snapshot.data, nil
+	}
+
+	data, err := k8s.ReadLog(l.logClient, file, logSizeLimit)
+	if err != nil {
+		return nil, err
+	}
+	l.snapshots[key] = logSnapshot{data: data, taken: time.Now()}
+	return data, nil
+}
+
+// fileInfo describes a log with its current size, or 0 when it cannot be read.
+func (l *logsFS) fileInfo(file k8s.LogFile) os.FileInfo {
+	data, err := l.read(file)
+	if err != nil {
+		log.Printf("Failed to read log of %s/%s: %v", file.Pod, file.Container, err)
+	}
+	return &fileInfo{name: logName(file), size: int64(len(data)), mode: 0o444, modTime: file.ModTime}
+}
+
+func (l *logsFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	_, file, err := l.lookup(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil {
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: syscall.EISDIR}
+	}
+	data, err := l.read(*file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (l *logsFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, denied("open", r.Filepath)
+}
+
+func (l *logsFS) Filecmd(r *sftp.Request) error {
+	return denied(strings.ToLower(r.Method), r.Filepath)
+}
+
+func (l *logsFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	entries, logFile, err := l.lookup(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	var file os.FileInfo
+	if logFile != nil {
+		file = l.fileInfo(*logFile)
+	} else {
+		file = virtualDir(path.Base(r.Filepath))
+	}
+
+	switch r.Method {
+	case "List":
+		if logFile != nil {
+			return listerAt{file}, nil
+		}
+		return listerAt(entries), nil
+	case "Stat":
+		return listerAt{file}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
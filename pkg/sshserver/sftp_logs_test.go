@@ -0,0 +1,127 @@
+package sshserver
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientFake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSFTPLogsFS(t *testing.T) {
+	clientset := clientFake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "web", Labels: map[string]string{"app": "web"}},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:                 "app",
+					State:                corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+					LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}},
+				},
+				{Name: "sidecar", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			},
+		},
+	})
+	fs := newLogsFS(clientset, clientset, map[string]string{"service": "web", "secretNamespace": "web", "podLabelSelector": "app=web"})
+	client := createSFTPClient(t, startSFTPServer(t, writeTestKey(t), AppFS, fs))
+	defer client.Close()
+
+	names := func(name string) []string {
+		entries, err := client.ReadDir(name)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"logs"}, names("/"))
+	assert.Equal(t, []string{"web-1"}, names("/logs"))
+	assert.Equal(t, []string{"app.log", "app.previous.log", "sidecar.log"}, names("/logs/web-1"))
+
+	wd, err := client.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, "/logs", wd)
+
+	// The fake clientset serves every log as "fake logs"
+	file, err := client.Open("/logs/web-1/app.previous.log")
+	require.NoError(t, err)
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, "fake logs", string(data))
+
+	buf := make([]byte, 4)
+	n, err := file.ReadAt(buf, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "logs", string(buf[:n]), "Reads may start anywhere in the log")
+	file.Close()
+
+	logReads := func() int {
+		reads := 0
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "get" && action.GetSubresource() == "log" {
+				reads++
+			}
+		}
+		return reads
+	}
+	before := logReads()
+	require.NotZero(t, before, "Listing reads the logs for their size")
+	info, err := client.Stat("/logs/web-1/sidecar.log")
+	require.NoError(t, err)
+	assert.EqualValues(t, len("fake logs"), info.Size(), "Logs report their real size")
+	file, err = client.Open("/logs/web-1/sidecar.log")
+	require.NoError(t, err)
+	for off := int64(0); off < info.Size(); off += 3 {
+		_, err = file.ReadAt(buf[:3], off)
+		require.NoError(t, err)
+	}
+	file.Close()
+	assert.Equal(t, before, logReads(), "Stat and ranged reads reuse the log read for the listing")
+
+	_, err = client.Open("/logs/web-1/missing.log")
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.Create("/logs/web-1/app.log")
+	assert.True(t, os.IsPermission(err), "Logs are read-only")
+	assert.True(t, os.IsPermission(client.Remove("/logs/web-1/app.log")))
+}
+
+func TestSFTPLogsFSAccessReview(t *testing.T) {
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "web", Labels: map[string]string{"app": "web"}},
+			Status: corev1.PodStatus{
+				Phase:             corev1.PodRunning,
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}},
+			},
+		}
+	}
+	clientset := clientFake.NewSimpleClientset(pod("logs-1"), pod("logs-2"))
+	clientset.PrependReactor("create", "subjectaccessreviews", allowPods("logs-2"))
+	fs := newLogsFS(clientset, clientset, map[string]string{
+		"service":          "web",
+		"secretNamespace":  "web",
+		"podLabelSelector": "app=web",
+		"kubernetesUser":   "erin@example.com",
+	})
+	client := createSFTPClient(t, startSFTPServer(t, writeTestKey(t), AppFS, fs))
+	defer client.Close()
+
+	entries, err := client.ReadDir("/logs")
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "Pods whose logs the user may not read are not listed")
+	assert.Equal(t, "logs-2", entries[0].Name())
+
+	_, err = client.Stat("/logs/logs-1/app.log")
+	assert.True(t, os.IsNotExist(err))
+	_, err = client.Open("/logs/logs-1/app.log")
+	assert.True(t, os.IsNotExist(err))
+	file, err := client.Open("/logs/logs-2/app.log")
+	require.NoError(t, err)
+	file.Close()
+}
@@ -0,0 +1,237 @@
+package sshserver
+
+import (
+	"io"
+	"sync"
+)
+
+// sftpReadWindow caps the memory a single download holds. Clients keep
+// several reads in flight, so the window must cover the requests the server
+// workers may handle out of order.
+const sftpReadWindow = 2 << 20
+
+// sftpWriteWindow caps how much of an upload is held back waiting for an
+// earlier offset to arrive.
+const sftpWriteWindow = 2 << 20
+
+// sftpReadChunk is how much is read from the container at a time.
+const sftpReadChunk = 32 << 10
+
+// streamReader serves ReadAt calls from a sequential stream. The most recent
+// window bytes are kept so reads arriving slightly out of order are served
+// from memory; reads further away restart the stream at the new offset.
+type streamReader struct {
+	open   func(off int64) io.ReadCloser
+	window int
+
+	mu     sync.Mutex
+	stream io.ReadCloser
+	pos    int64  // offset of the next byte read from stream
+	buf    []byte // the bytes just before pos
+	eof    bool
+	closed bool
+}
+
+func newStreamReader(open func(off int64) io.ReadCloser, window int) *streamReader {
+	return &streamReader{open: open, window: window}
+}
+
+func (r *streamReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	if r.stream == nil && off <= int64(r.window) {
+		// The first reads of a download may arrive out of order too
+		r.restart(0)
+	}
+	start := r.pos - int64(len(r.buf))
+	if r.stream == nil || off < start || off > r.pos+int64(r.window) {
+		r.restart(off)
+	}
+
+	end := off + int64(len(p))
+	for r.pos < end && !r.eof {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	start = r.pos - int64(len(r.buf))
+	if off >= r.pos {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf[off-start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// restart replaces the stream with one starting at off.
+func (r *streamReader) restart(off int64) {
+	if r.stream != nil {
+		r.stream.Close()
+	}
+	r.stream = r.open(off)
+	r.pos = off
+	r.buf = r.buf[:0]
+	r.eof = false
+}
+
+// fill reads the next chunk of the stream, dropping bytes that fall out of
+// the window.
+func (r *streamReader) fill() error {
+	if cap(r.buf) == 0 {
+		r.buf = make([]byte, 0, r.window+sftpReadChunk)
+	}
+	if excess := len(r.buf) + sftpReadChunk - r.window; excess > 0 {
+		if excess > len(r.buf) {
+			excess = len(r.buf)
+		}
+		r.buf = r.buf[:copy(r.buf, r.buf[excess:])]
+	}
+
+	n, err := r.stream.Read(r.buf[len(r.buf) : len(r.buf)+sftpReadChunk])
+	r.buf = r.buf[:len(r.buf)+n]
+	r.pos += int64(n)
+	if err == io.EOF {
+		r.eof = true
+		return nil
+	}
+	return err
+}
+
+func (r *streamReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.stream != nil {
+		return r.stream.Close()
+	}
+	return nil
+}
+
+// streamWriter turns WriteAt calls into sequential streams, each started by
+// run at the offset of the write that opens it. Writes arriving ahead of the
+// stream are held until the gap is filled, up to window bytes. Writes before
+// the stream, or too far ahead of it, end it and start a new one there; data
+// still held when the writer closes gets streams of its own.
+type streamWriter struct {
+	run    func(off int64, stdin io.Reader) error
+	window int
+
+	mu      sync.Mutex
+	next    int64
+	pending map[int64][]byte
+	held    int
+	pipe    *io.PipeWriter
+	done    chan struct{}
+	err     error
+}
+
+func newStreamWriter(run func(off int64, stdin io.Reader) error, window int) *streamWriter {
+	return &streamWriter{run: run, window: window, pending: make(map[int64][]byte)}
+}
+
+func (w *streamWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.pipe != nil && off > w.next && w.held+len(p) <= w.window {
+		w.pending[off] = append([]byte(nil), p...)
+		w.held += len(p)
+		return len(p), nil
+	}
+	if w.pipe == nil || off != w.next {
+		if err := w.start(off); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.write(p); err != nil {
+		return 0, err
+	}
+	if err := w.drain(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start ends the current stream, if any, and starts one at off.
+func (w *streamWriter) start(off int64) error {
+	if err := w.stop(); err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	w.pipe, w.done, w.next = pw, done, off
+	go func() {
+		defer close(done)
+		err := w.run(off, pr)
+		if err != nil {
+			w.err = err
+		}
+		pr.CloseWithError(err)
+	}()
+	return nil
+}
+
+// stop ends the current stream and reports whether everything was stored.
+func (w *streamWriter) stop() error {
+	if w.pipe != nil {
+		w.pipe.Close()
+		<-w.done
+		w.pipe = nil
+	}
+	return w.err
+}
+
+// write sends data down the current stream.
+func (w *streamWriter) write(data []byte) error {
+	if _, err := w.pipe.Write(data); err != nil {
+		return err
+	}
+	w.next += int64(len(data))
+	return nil
+}
+
+// drain writes the held data that continues the current stream.
+func (w *streamWriter) drain() error {
+	for {
+		data, ok := w.pending[w.next]
+		if !ok {
+			return nil
+		}
+		delete(w.pending, w.next)
+		w.held -= len(data)
+		if err := w.write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// Close writes whatever is still held, ends the stream and reports whether
+// the data was stored.
+func (w *streamWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.pending) > 0 {
+		off := int64(-1)
+		for pending := range w.pending {
+			if off < 0 || pending < off {
+				off = pending
+			}
+		}
+		if w.pipe == nil || off != w.next {
+			if err := w.start(off); err != nil {
+				return err
+			}
+		}
+		if err := w.drain(); err != nil {
+			return err
+		}
+	}
+	return w.stop()
+}
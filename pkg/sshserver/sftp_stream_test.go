@@ -0,0 +1,169 @@
+package sshserver
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStreamReader(data []byte, window int) (*streamReader, *[]int64) {
+	var opens []int64
+	reader := newStreamReader(func(off int64) io.ReadCloser {
+		opens = append(opens, off)
+		return io.NopCloser(bytes.NewReader(data[off:]))
+	}, window)
+	return reader, &opens
+}
+
+func TestStreamReader(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	window := 4 * sftpReadChunk
+
+	t.Run("sequential reads use one stream", func(t *testing.T) {
+		reader, opens := newTestStreamReader(data, window)
+		var got []byte
+		p := make([]byte, 10000)
+		for off := int64(0); ; off += int64(len(p)) {
+			n, err := reader.ReadAt(p, off)
+			got = append(got, p[:n]...)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+		assert.Equal(t, data, got)
+		assert.Equal(t, []int64{0}, *opens)
+		assert.LessOrEqual(t, cap(reader.buf), window+sftpReadChunk, "Memory should stay within the window")
+	})
+
+	t.Run("out of order reads within the window", func(t *testing.T) {
+		reader, opens := newTestStreamReader(data, window)
+		p := make([]byte, 100)
+		for _, off := range []int64{3000, 1000, 5000, 0, 4000} {
+			n, err := reader.ReadAt(p, off)
+			require.NoError(t, err)
+			assert.Equal(t, data[off:off+100], p[:n])
+		}
+		assert.Equal(t, []int64{0}, *opens)
+	})
+
+	t.Run("distant offsets restart the stream", func(t *testing.T) {
+		reader, opens := newTestStreamReader(data, window)
+		p := make([]byte, 100)
+		for _, off := range []int64{0, 900000, 10} {
+			n, err := reader.ReadAt(p, off)
+			require.NoError(t, err)
+			assert.Equal(t, data[off:off+100], p[:n])
+		}
+		assert.Equal(t, []int64{0, 900000, 10}, *opens)
+	})
+
+	t.Run("reads past the end", func(t *testing.T) {
+		reader, _ := newTestStreamReader(data, window)
+		p := make([]byte, 100)
+		n, err := reader.ReadAt(p, int64(len(data)-40))
+		assert.Equal(t, 40, n)
+		assert.Equal(t, io.EOF, err)
+
+		n, err = reader.ReadAt(p, int64(len(data)))
+		assert.Equal(t, 0, n)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("stream errors reach the caller", func(t *testing.T) {
+		reader := newStreamReader(func(off int64) io.ReadCloser {
+			pr, pw := io.Pipe()
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+			return pr
+		}, window)
+		_, err := reader.ReadAt(make([]byte, 10), 0)
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+}
+
+// testFile is a file written in place by the streams of a streamWriter.
+type testFile struct {
+	mu      sync.Mutex
+	data    []byte
+	streams []int64
+}
+
+func (f *testFile) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(f.data)
+}
+
+func newTestStreamWriter(window int) (*streamWriter, *testFile) {
+	file := &testFile{}
+	writer := newStreamWriter(func(off int64, stdin io.Reader) error {
+		data, err := io.ReadAll(stdin)
+		file.mu.Lock()
+		defer file.mu.Unlock()
+		file.streams = append(file.streams, off)
+		if end := off + int64(len(data)); end > int64(len(file.data)) {
+			file.data = append(file.data, make([]byte, end-int64(len(file.data)))...)
+		}
+		copy(file.data[off:], data)
+		return err
+	}, window)
+	return writer, file
+}
+
+func TestStreamWriter(t *testing.T) {
+	t.Run("out of order writes", func(t *testing.T) {
+		writer, file := newTestStreamWriter(100)
+		for _, off := range []int64{0, 10, 30, 20} {
+			n, err := writer.WriteAt(bytes.Repeat([]byte{byte('a' + off/10)}, 10), off)
+			require.NoError(t, err)
+			assert.Equal(t, 10, n)
+		}
+		require.NoError(t, writer.Close())
+		assert.Equal(t, "aaaaaaaaaabbbbbbbbbbccccccccccdddddddddd", file.String())
+		assert.Equal(t, []int64{0}, file.streams, "Held writes continue the stream")
+	})
+
+	t.Run("writes land at their offset", func(t *testing.T) {
+		writer, file := newTestStreamWriter(100)
+		file.data = []byte("0123456789")
+		_, err := writer.WriteAt([]byte("resumed"), 10)
+		require.NoError(t, err)
+		_, err = writer.WriteAt([]byte("x"), 2)
+		require.NoError(t, err, "Earlier data can be rewritten")
+		require.NoError(t, writer.Close())
+		assert.Equal(t, "01x3456789resumed", file.String())
+		assert.Equal(t, []int64{10, 2}, file.streams)
+	})
+
+	t.Run("held data is bounded", func(t *testing.T) {
+		writer, file := newTestStreamWriter(15)
+		_, err := writer.WriteAt([]byte("a"), 0)
+		require.NoError(t, err)
+		_, err = writer.WriteAt(bytes.Repeat([]byte("c"), 10), 10)
+		require.NoError(t, err)
+		_, err = writer.WriteAt(bytes.Repeat([]byte("d"), 10), 20)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, writer.held, 15)
+		require.NoError(t, writer.Close(), "Gaps are left as holes")
+		assert.Equal(t, "a"+strings.Repeat("\x00", 9)+strings.Repeat("c", 10)+strings.Repeat("d", 10), file.String())
+	})
+
+	t.Run("stream errors reach the caller", func(t *testing.T) {
+		writer := newStreamWriter(func(off int64, stdin io.Reader) error {
+			return io.ErrShortWrite
+		}, 100)
+		_, err := writer.WriteAt([]byte("data"), 0)
+		if err == nil {
+			err = writer.Close()
+		}
+		assert.Equal(t, io.ErrShortWrite, err)
+	})
+}
@@ -1,23 +1,42 @@
 package sshserver
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientFake "k8s.io/client-go/kubernetes/fake"
 
 	"github.com/pkg/sftp"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/rest/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/remotecommand"
 )
 
 var AppFS afero.Fs // Define the AppFS variable here
 
 // Function to start an SFTP server
-func startSFTPServer(t *testing.T, privateKeyPath string, fs afero.Fs, clientset kubernetes.Interface, config *rest.Config) string {
+func startSFTPServer(t *testing.T, privateKeyPath string, fs afero.Fs, handler sftpFS) string {
 	privateBytes, err := ioutil.ReadFile(privateKeyPath)
 	require.NoError(t, err, "Failed to read private key")
 
@@ -45,7 +64,12 @@ func startSFTPServer(t *testing.T, privateKeyPath string, fs afero.Fs, clientset
 				channel, requests, err := newChannel.Accept()
 				require.NoError(t, err, "Failed to accept channel")
 
-				go handleSFTP(channel, clientset, config, "default", "test-pod", "test-container")
+				go func() {
+					for req := range requests {
+						req.Reply(req.Type == "subsystem", nil)
+					}
+				}()
+				go handleSFTP(channel, handler)
 			}
 		}
 	}()
@@ -68,9 +92,846 @@ func createSFTPClient(t *testing.T, addr string) *sftp.Client {
 	return client
 }
 
+// localExecutor runs the command of a pods/exec request on the test machine,
+// standing in for the container.
+type localExecutor struct {
+	command []string
+}
+
+func (e *localExecutor) Stream(options remotecommand.StreamOptions) error {
+	cmd := exec.Command(e.command[0], e.command[1:]...)
+	cmd.Stdin = options.Stdin
+	cmd.Stdout = options.Stdout
+	cmd.Stderr = options.Stderr
+	return cmd.Run()
+}
+
+func newLocalExecutor(config *rest.Config, method string, u *url.URL) (k8s.Executor, error) {
+	return &localExecutor{command: u.Query()["command"]}, nil
+}
+
+func newTestSFTPHandler() *SFTPHandler {
+	return &SFTPHandler{
+		RESTClient:    &fake.RESTClient{},
+		Config:        &rest.Config{Host: "http://localhost"},
+		Namespace:     "default",
+		PodName:       "test-pod",
+		ContainerName: "test-container",
+		NewExecutor:   newLocalExecutor,
+	}
+}
+
+func writeTestKey(t *testing.T) string {
+	privateBytes, err := generatePrivateKey()
+	require.NoError(t, err, "Failed to generate private key")
+	privateKeyPath := filepath.Join(t.TempDir(), "id_rsa")
+	require.NoError(t, os.WriteFile(privateKeyPath, privateBytes, 0600))
+	return privateKeyPath
+}
+
+func TestSFTPSubsystem(t *testing.T) {
+	initTestCache()
+	clientset := clientFake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "default",
+			Labels:    map[string]string{"testpodlabelselector": "true"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test-container"}},
+		},
+	})
+	config := &rest.Config{Host: "http://localhost"}
+
+	privateBytes, err := generatePrivateKey()
+	require.NoError(t, err, "Failed to generate private key")
+	signer, err := ssh.ParsePrivateKey(privateBytes)
+	require.NoError(t, err, "Failed to parse private key")
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sshConn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+					// The container has no sftp-server, so the session is emulated
+					executor := &localExecutor{command: []string{"false"}}
+					go handleSSHRequests(clientset, &fake.RESTClient{}, config, executor, channel, requests, sshConn.User(), Options{})
+				}
+			}()
+		}
+	}()
+
+	dial := func(user string) (*sftp.Client, error) {
+		conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return sftp.NewClient(conn)
+	}
+
+	client, err := dial("default-testuser")
+	require.NoError(t, err, "The sftp subsystem should be accepted for a routed user")
+	client.Close()
+
+	_, err = dial("default-unknown")
+	assert.Error(t, err, "The sftp subsystem should be refused for users without a route")
+}
+
+func TestSFTPHandler(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.log"), []byte("hello world"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "archive"), 0755))
+
+	addr := startSFTPServer(t, writeTestKey(t), AppFS, newTestSFTPHandler())
+	client := createSFTPClient(t, addr)
+	defer client.Close()
+
+	t.Run("list directory", func(t *testing.T) {
+		entries, err := client.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		assert.Equal(t, []string{"app.log", "archive"}, names)
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		info, err := client.Stat(filepath.Join(dir, "app.log"))
+		require.NoError(t, err)
+		assert.Equal(t, int64(11), info.Size())
+		assert.Equal(t, os.FileMode(0644), info.Mode())
+
+		info, err = client.Stat(filepath.Join(dir, "archive"))
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		_, err = client.Stat(filepath.Join(dir, "missing"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("read file", func(t *testing.T) {
+		file, err := client.Open(filepath.Join(dir, "app.log"))
+		require.NoError(t, err)
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(data))
+	})
+
+	t.Run("stream large file", func(t *testing.T) {
+		data := make([]byte, 3*sftpReadWindow+123)
+		for i := range data {
+			data[i] = byte(i % 251)
+		}
+		large := filepath.Join(dir, "dump.bin")
+		require.NoError(t, os.WriteFile(large, data, 0644))
+		defer os.Remove(large)
+
+		file, err := client.Open(large)
+		require.NoError(t, err)
+		defer file.Close()
+		var got bytes.Buffer
+		_, err = file.WriteTo(&got)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got.Bytes()), "Downloaded data should match")
+
+		// Resume from an offset, as `reget` does
+		_, err = file.Seek(int64(len(data)-1000), io.SeekStart)
+		require.NoError(t, err)
+		rest, err := io.ReadAll(file)
+		require.NoError(t, err)
+		assert.Equal(t, data[len(data)-1000:], rest)
+	})
+
+	t.Run("upload file", func(t *testing.T) {
+		data := make([]byte, 3*sftpWriteWindow+321)
+		for i := range data {
+			data[i] = byte(i % 253)
+		}
+		upload := filepath.Join(dir, "upload.bin")
+		defer os.Remove(upload)
+
+		file, err := client.Create(upload)
+		require.NoError(t, err)
+		_, err = file.ReadFrom(bytes.NewReader(data[:len(data)/2]))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		// Resume the upload from the remote size, as `put -a` does
+		info, err := client.Stat(upload)
+		require.NoError(t, err)
+		file, err = client.OpenFile(upload, os.O_WRONLY)
+		require.NoError(t, err)
+		_, err = file.Seek(info.Size(), io.SeekStart)
+		require.NoError(t, err)
+		_, err = file.ReadFrom(bytes.NewReader(data[info.Size():]))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		got, err := os.ReadFile(upload)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got), "Uploaded data should match")
+
+		// Create truncates existing files
+		file, err = client.Create(upload)
+		require.NoError(t, err)
+		_, err = file.Write([]byte("short"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		got, err = os.ReadFile(upload)
+		require.NoError(t, err)
+		assert.Equal(t, "short", string(got))
+
+		// Without truncation, writes before the end replace bytes in place
+		file, err = client.OpenFile(upload, os.O_WRONLY)
+		require.NoError(t, err)
+		_, err = file.WriteAt([]byte("i"), 2)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		got, err = os.ReadFile(upload)
+		require.NoError(t, err)
+		assert.Equal(t, "shirt", string(got))
+
+		file, err = client.OpenFile(upload, os.O_WRONLY|os.O_APPEND)
+		require.NoError(t, err)
+		_, err = file.Write([]byte("s"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		got, err = os.ReadFile(upload)
+		require.NoError(t, err)
+		assert.Equal(t, "shirts", string(got))
+	})
+
+	t.Run("upload to missing directory", func(t *testing.T) {
+		_, err := client.Create(filepath.Join(dir, "missing", "upload.bin"))
+		assert.Error(t, err)
+	})
+
+	t.Run("open missing file", func(t *testing.T) {
+		_, err := client.Open(filepath.Join(dir, "missing"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("mkdir and rmdir", func(t *testing.T) {
+		sub := filepath.Join(dir, "sub")
+		require.NoError(t, client.Mkdir(sub))
+		info, err := os.Stat(sub)
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		require.NoError(t, client.RemoveDirectory(sub))
+		_, err = os.Stat(sub)
+		assert.True(t, os.IsNotExist(err))
+
+		assert.ErrorIs(t, client.RemoveDirectory(sub), os.ErrNotExist)
+	})
+
+	t.Run("symlinks", func(t *testing.T) {
+		link := filepath.Join(dir, "current.log")
+		require.NoError(t, client.Symlink("app.log", link))
+		defer os.Remove(link)
+
+		target, err := client.ReadLink(link)
+		require.NoError(t, err)
+		assert.Equal(t, "app.log", target)
+
+		info, err := client.Lstat(link)
+		require.NoError(t, err)
+		assert.Equal(t, "current.log", info.Name())
+		assert.True(t, info.Mode()&os.ModeSymlink != 0, "Lstat should describe the link")
+
+		info, err = client.Stat(link)
+		require.NoError(t, err)
+		assert.True(t, info.Mode().IsRegular(), "Stat should follow the link")
+		assert.Equal(t, int64(11), info.Size())
+
+		resolved, err := client.RealPath(link)
+		require.NoError(t, err)
+		realDir, err := filepath.EvalSymlinks(dir)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(realDir, "app.log"), resolved)
+	})
+
+	t.Run("realpath", func(t *testing.T) {
+		resolved, err := client.RealPath(".")
+		require.NoError(t, err)
+		assert.Equal(t, "/", resolved)
+
+		resolved, err = client.RealPath(filepath.Join(dir, "archive", "..", "not-yet-uploaded"))
+		require.NoError(t, err)
+		assert.Equal(t, "not-yet-uploaded", filepath.Base(resolved))
+	})
+
+	t.Run("setstat", func(t *testing.T) {
+		name := filepath.Join(dir, "setstat.txt")
+		require.NoError(t, os.WriteFile(name, []byte("0123456789"), 0644))
+		defer os.Remove(name)
+
+		mtime := time.Unix(1600000000, 0)
+		atime := time.Unix(1500000000, 0)
+		require.NoError(t, client.Truncate(name, 4))
+		require.NoError(t, client.Chown(name, os.Getuid(), os.Getgid()))
+		require.NoError(t, client.Chtimes(name, atime, mtime))
+
+		info, err := client.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), info.Size())
+		assert.True(t, mtime.Equal(info.ModTime()), "Modification time should be set")
+		stat, ok := info.Sys().(*sftp.FileStat)
+		require.True(t, ok)
+		assert.Equal(t, uint32(os.Getuid()), stat.UID)
+		assert.Equal(t, uint32(os.Getgid()), stat.GID)
+
+		assert.ErrorIs(t, client.Chmod(filepath.Join(dir, "missing"), 0600), os.ErrNotExist)
+	})
+
+	t.Run("rename chmod and remove", func(t *testing.T) {
+		renamed := filepath.Join(dir, "renamed.log")
+		require.NoError(t, client.Rename(filepath.Join(dir, "app.log"), renamed))
+		require.NoError(t, client.Chmod(renamed, 0600))
+		info, err := os.Stat(renamed)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode())
+
+		require.NoError(t, client.Remove(renamed))
+		_, err = os.Stat(renamed)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestSFTPHandlerHostileFilenames(t *testing.T) {
+	dir := t.TempDir()
+	// Filenames cannot contain slashes, so injected commands would run
+	// relative to the working directory of the test
+	pwned := "sftp-pwned"
+	defer os.Remove(pwned)
+	names := []string{
+		"x; touch " + pwned,
+		"$(touch " + pwned + ")",
+		"`touch " + pwned + "`",
+		"a'b\"c && touch " + pwned,
+		"-rf",
+		"* ?",
+	}
+
+	addr := startSFTPServer(t, writeTestKey(t), AppFS, newTestSFTPHandler())
+	client := createSFTPClient(t, addr)
+	defer client.Close()
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			target := filepath.Join(dir, name)
+			file, err := client.Create(target)
+			require.NoError(t, err)
+			_, err = file.Write([]byte("payload"))
+			require.NoError(t, err)
+			require.NoError(t, file.Close())
+
+			data, err := os.ReadFile(target)
+			require.NoError(t, err)
+			assert.Equal(t, "payload", string(data))
+
+			file, err = client.Open(target)
+			require.NoError(t, err)
+			data, err = io.ReadAll(file)
+			file.Close()
+			require.NoError(t, err)
+			assert.Equal(t, "payload", string(data))
+
+			info, err := client.Stat(target)
+			require.NoError(t, err)
+			assert.Equal(t, name, info.Name())
+
+			entries, err := client.ReadDir(dir)
+			require.NoError(t, err)
+			var listed []string
+			for _, entry := range entries {
+				listed = append(listed, entry.Name())
+			}
+			assert.Contains(t, listed, name)
+
+			require.NoError(t, client.Chmod(target, 0600))
+			renamed := target + " renamed"
+			require.NoError(t, client.Rename(target, renamed))
+			require.NoError(t, client.Remove(renamed))
+
+			_, err = os.Stat(pwned)
+			assert.True(t, os.IsNotExist(err), "Filenames must not be executed")
+			entries, err = client.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func TestSFTPHandlerConfinement(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	root := filepath.Join(dir, "var", "log", "app")
+	require.NoError(t, os.MkdirAll(root, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "app.log"), []byte("log line"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink(dir, filepath.Join(root, "escape-dir")))
+
+	handler := newTestSFTPHandler()
+	handler.Roots = handler.resolveRoots([]string{filepath.Join(dir, "var", "log", "..", "log", "app")})
+	require.Equal(t, []string{root}, handler.Roots)
+
+	addr := startSFTPServer(t, writeTestKey(t), AppFS, handler)
+	client := createSFTPClient(t, addr)
+	defer client.Close()
+
+	t.Run("starts in the root", func(t *testing.T) {
+		cwd, err := client.Getwd()
+		require.NoError(t, err)
+		assert.Equal(t, root, cwd)
+
+		entries, err := client.ReadDir(".")
+		require.NoError(t, err)
+		assert.Len(t, entries, 3)
+	})
+
+	t.Run("paths inside the root", func(t *testing.T) {
+		file, err := client.Open(filepath.Join(root, "app.log"))
+		require.NoError(t, err)
+		data, err := io.ReadAll(file)
+		file.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "log line", string(data))
+
+		info, err := client.Lstat(filepath.Join(root, "escape"))
+		require.NoError(t, err, "Symlinks themselves are inside the root")
+		assert.True(t, info.Mode()&os.ModeSymlink != 0)
+
+		file, err = client.Create(filepath.Join(root, "upload.txt"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		require.NoError(t, client.Remove(filepath.Join(root, "upload.txt")))
+	})
+
+	t.Run("paths outside the root", func(t *testing.T) {
+		for _, name := range []string{
+			filepath.Join(dir, "secret"),
+			filepath.Join(root, "..", "..", "..", "secret"),
+			filepath.Join(root, "escape"),
+			filepath.Join(root, "escape-dir", "secret"),
+			"/etc/passwd",
+		} {
+			_, err := client.Open(name)
+			assert.ErrorIs(t, err, os.ErrPermission, name)
+			_, err = client.Stat(name)
+			assert.ErrorIs(t, err, os.ErrPermission, name)
+		}
+
+		_, err := client.ReadDir(dir)
+		assert.ErrorIs(t, err, os.ErrPermission)
+		_, err = client.ReadDir(filepath.Join(root, "escape-dir"))
+		assert.ErrorIs(t, err, os.ErrPermission)
+		_, err = client.Create(filepath.Join(root, "escape-dir", "planted"))
+		assert.ErrorIs(t, err, os.ErrPermission)
+		err = client.Rename(filepath.Join(root, "app.log"), filepath.Join(dir, "stolen.log"))
+		assert.ErrorIs(t, err, os.ErrPermission)
+		_, err = client.RealPath(filepath.Join(root, "escape"))
+		assert.ErrorIs(t, err, os.ErrPermission)
+
+		_, err = os.Stat(filepath.Join(dir, "planted"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(root, "app.log"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("followed symlinks are replaced by their target", func(t *testing.T) {
+		link := filepath.Join(root, "current.log")
+		require.NoError(t, os.Symlink(filepath.Join(root, "app.log"), link))
+		defer os.Remove(link)
+
+		resolved, err := handler.confine(link, true)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(root, "app.log"), resolved)
+		unfollowed, err := handler.confine(link, false)
+		require.NoError(t, err)
+		assert.Equal(t, link, unfollowed)
+
+		// Retargeting the link after the check must not redirect the operation
+		require.NoError(t, os.Remove(link))
+		require.NoError(t, os.Symlink(filepath.Join(dir, "secret"), link))
+		data, err := os.ReadFile(resolved)
+		require.NoError(t, err)
+		assert.Equal(t, "log line", string(data))
+
+		_, err = handler.confine(link, true)
+		assert.ErrorIs(t, err, os.ErrPermission, "A base linking outside the root is refused")
+	})
+
+	t.Run("unresolvable roots refuse everything", func(t *testing.T) {
+		handler := newTestSFTPHandler()
+		handler.Roots = []string{}
+		_, err := handler.confine(filepath.Join(root, "app.log"), true)
+		assert.ErrorIs(t, err, os.ErrPermission)
+	})
+}
+
+func TestSFTPHandlerReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.log"), []byte("log line"), 0644))
+
+	handler := newTestSFTPHandler()
+	handler.ReadOnly = true
+	addr := startSFTPServer(t, writeTestKey(t), AppFS, handler)
+	client := createSFTPClient(t, addr)
+	defer client.Close()
+
+	file, err := client.Open(filepath.Join(dir, "app.log"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(file)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "log line", string(data))
+
+	_, err = client.Create(filepath.Join(dir, "upload.txt"))
+	assert.ErrorIs(t, err, os.ErrPermission)
+	assert.ErrorIs(t, client.Remove(filepath.Join(dir, "app.log")), os.ErrPermission)
+	assert.ErrorIs(t, client.Rename(filepath.Join(dir, "app.log"), filepath.Join(dir, "moved.log")), os.ErrPermission)
+	assert.ErrorIs(t, client.PosixRename(filepath.Join(dir, "app.log"), filepath.Join(dir, "moved.log")), os.ErrPermission)
+	assert.ErrorIs(t, client.Mkdir(filepath.Join(dir, "sub")), os.ErrPermission)
+	assert.ErrorIs(t, client.Chmod(filepath.Join(dir, "app.log"), 0777), os.ErrPermission)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "Nothing should have changed")
+}
+
+// nativeSFTPExecutor stands in for a container shipping OpenSSH: the probe
+// finds sftp-server, which is served by pkg/sftp's own server.
+type nativeSFTPExecutor struct {
+	command  []string
+	readOnly *bool
+}
+
+func (e *nativeSFTPExecutor) Stream(options remotecommand.StreamOptions) error {
+	if e.command[0] != "/usr/lib/openssh/sftp-server" {
+		_, err := io.WriteString(options.Stdout, "/usr/lib/openssh/sftp-server\n")
+		return err
+	}
+	var opts []sftp.ServerOption
+	*e.readOnly = len(e.command) > 1 && e.command[1] == "-R"
+	if *e.readOnly {
+		opts = append(opts, sftp.ReadOnly())
+	}
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{options.Stdin, nopWriteCloser{options.Stdout}}, opts...)
+	if err != nil {
+		return err
+	}
+	if err := server.Serve(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestSFTPNativeServer(t *testing.T) {
+	for _, readOnly := range []bool{false, true} {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "app.log"), []byte("log line"), 0644))
+
+		var servedReadOnly bool
+		handler := newTestSFTPHandler()
+		handler.ReadOnly = readOnly
+		handler.NewExecutor = func(config *rest.Config, method string, u *url.URL) (k8s.Executor, error) {
+			return &nativeSFTPExecutor{command: u.Query()["command"], readOnly: &servedReadOnly}, nil
+		}
+		handler.NativeServer = handler.probeSFTPServer()
+		require.Equal(t, "/usr/lib/openssh/sftp-server", handler.NativeServer)
+
+		addr := startSFTPServer(t, writeTestKey(t), AppFS, handler)
+		client := createSFTPClient(t, addr)
+
+		file, err := client.Open(filepath.Join(dir, "app.log"))
+		require.NoError(t, err)
+		data, err := io.ReadAll(file)
+		file.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "log line", string(data))
+
+		_, err = client.Create(filepath.Join(dir, "upload.txt"))
+		if readOnly {
+			assert.Error(t, err, "sftp-server should run with -R")
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, readOnly, servedReadOnly)
+		client.Close()
+	}
+
+	// Without sftp-server the handler falls back to emulation
+	handler := newTestSFTPHandler()
+	handler.NewExecutor = func(config *rest.Config, method string, u *url.URL) (k8s.Executor, error) {
+		return &localExecutor{command: []string{"false"}}, nil
+	}
+	assert.Empty(t, handler.probeSFTPServer())
+}
+
+func TestSFTPDispatcher(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "app.log"), []byte("log line"), 0644))
+
+	// Every container shares the local filesystem; record who ran commands
+	var mu sync.Mutex
+	var ran []string
+	targets := []k8s.Target{
+		{Namespace: "web", Pod: "web-1", Container: "app"},
+		{Namespace: "web", Pod: "web-1", Container: "sidecar"},
+		{Namespace: "web", Pod: "web-2", Container: "app"},
+	}
+	dispatcher := newSFTPDispatcher(targets, func(target k8s.Target) *SFTPHandler {
+		handler := newTestSFTPHandler()
+		handler.Namespace = target.Namespace
+		handler.PodName = target.Pod
+		handler.ContainerName = target.Container
+		handler.NewExecutor = func(config *rest.Config, method string, u *url.URL) (k8s.Executor, error) {
+			mu.Lock()
+			ran = append(ran, target.Pod+"/"+target.Container)
+			mu.Unlock()
+			return newLocalExecutor(config, method, u)
+		}
+		return handler
+	})
+	lastRan := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(ran) == 0 {
+			return ""
+		}
+		return ran[len(ran)-1]
+	}
+
+	client := createSFTPClient(t, startSFTPServer(t, writeTestKey(t), AppFS, dispatcher))
+	defer client.Close()
+
+	names := func(entries []os.FileInfo) []string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	t.Run("virtual directories", func(t *testing.T) {
+		entries, err := client.ReadDir("/")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"web-1", "web-2"}, names(entries))
+		assert.True(t, entries[0].IsDir())
+
+		entries, err = client.ReadDir("/web-1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app", "sidecar"}, names(entries))
+
+		info, err := client.Stat("/web-2")
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		_, err = client.Stat("/web-3")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = client.Stat("/web-2/sidecar")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		_, err = client.Create("/web-1/planted")
+		assert.ErrorIs(t, err, os.ErrPermission)
+		assert.ErrorIs(t, client.Mkdir("/web-3"), os.ErrPermission)
+	})
+
+	t.Run("operations reach their container", func(t *testing.T) {
+		file, err := client.Open("/web-2/app" + dir + "/app.log")
+		require.NoError(t, err)
+		data, err := io.ReadAll(file)
+		file.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "log line", string(data))
+		assert.Equal(t, "web-2/app", lastRan())
+
+		entries, err := client.ReadDir("/web-1/sidecar" + dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app.log"}, names(entries))
+		assert.Equal(t, "web-1/sidecar", lastRan())
+
+		file, err = client.Create("/web-1/app" + dir + "/upload.txt")
+		require.NoError(t, err)
+		_, err = file.Write([]byte("uploaded"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		data, err = os.ReadFile(filepath.Join(dir, "upload.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "uploaded", string(data))
+
+		require.NoError(t, client.Rename("/web-1/app"+dir+"/upload.txt", "/web-1/app"+dir+"/renamed.txt"))
+		assert.Error(t, client.Rename("/web-1/app"+dir+"/renamed.txt", "/web-2/app"+dir+"/moved.txt"), "Renames cannot cross containers")
+
+		resolved, err := client.RealPath("/web-2/app" + dir + "/../" + filepath.Base(dir) + "/renamed.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "/web-2/app"+dir+"/renamed.txt", resolved)
+	})
+}
+
+func TestSFTPVolumeRoute(t *testing.T) {
+	k8s.SetSecretInCache("data-volumeuser", map[string]string{
+		"service":         "data",
+		"secretNamespace": "data",
+		"pvc":             "exports",
+		"sftpReadOnly":    "true",
+	})
+	clientset := clientFake.NewSimpleClientset(&corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "exports", Namespace: "data"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+		},
+	})
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		action.(k8stesting.CreateAction).GetObject().(*corev1.Pod).Status.Phase = corev1.PodRunning
+		return false, nil, nil
+	})
+
+	fs, release, err := newSFTPHandler(clientset, &fake.RESTClient{}, &rest.Config{}, newLocalExecutor, "data-volumeuser", "registry.local/busybox")
+	require.NoError(t, err)
+	handler, ok := fs.(*SFTPHandler)
+	require.True(t, ok)
+	assert.Regexp(t, "^ssh-sftp-data-volumeuser-", handler.PodName)
+	assert.Equal(t, []string{k8s.VolumeMountPath}, handler.Roots, "Volume sessions start confined to the mount")
+	assert.True(t, handler.ReadOnly)
+
+	pod, err := clientset.CoreV1().Pods("data").Get(context.TODO(), handler.PodName, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "registry.local/busybox", pod.Spec.Containers[0].Image)
+
+	release()
+	_, err = clientset.CoreV1().Pods("data").Get(context.TODO(), handler.PodName, metav1.GetOptions{})
+	assert.Error(t, err, "The helper pod should be removed when the session ends")
+}
+
 func TestMain(m *testing.M) {
 	// Use the in-memory filesystem for testing
 	AppFS = afero.NewMemMapFs()
 	code := m.Run()
 	os.Exit(code)
 }
+
+func TestSFTPImpersonation(t *testing.T) {
+	k8s.SetSecretInCache("web-alice", map[string]string{
+		"service":          "web",
+		"secretNamespace":  "web",
+		"podLabelSelector": "app=web",
+		"containerName":    "app",
+		"kubernetesUser":   "alice@example.com",
+		"kubernetesGroups": "ops",
+	})
+	clientset := clientFake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "web", Labels: map[string]string{"app": "web"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", allowPods("web-1"))
+
+	// Record the config every pods/exec call is made with
+	var configs []*rest.Config
+	var mu sync.Mutex
+	newExecutor := func(config *rest.Config, method string, u *url.URL) (k8s.Executor, error) {
+		mu.Lock()
+		configs = append(configs, config)
+		mu.Unlock()
+		return newLocalExecutor(config, method, u)
+	}
+
+	routerConfig := &rest.Config{Host: "http://localhost"}
+	fs, _, err := newSFTPHandler(clientset, &fake.RESTClient{}, routerConfig, newExecutor, "web-alice", "")
+	require.NoError(t, err)
+	handler, ok := fs.(*SFTPHandler)
+	require.True(t, ok)
+	assert.Equal(t, "alice@example.com", handler.Config.Impersonate.UserName)
+	assert.Equal(t, []string{"ops"}, handler.Config.Impersonate.Groups)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, configs, "The sftp-server probe should exec in the pod")
+	for _, config := range configs {
+		assert.Equal(t, "alice@example.com", config.Impersonate.UserName)
+	}
+	assert.Empty(t, routerConfig.Impersonate.UserName, "The router's own config must not change")
+}
+
+// allowPods answers SubjectAccessReviews, allowing only the given pods.
+func allowPods(pods ...string) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		for _, pod := range pods {
+			if review.Spec.ResourceAttributes.Name == pod {
+				review.Status.Allowed = true
+			}
+		}
+		return true, review, nil
+	}
+}
+
+func TestSFTPAccessReview(t *testing.T) {
+	k8s.SetSecretInCache("web-carol", map[string]string{
+		"service":          "web",
+		"secretNamespace":  "web",
+		"podLabelSelector": "app=web",
+		"containerName":    "app",
+		"kubernetesUser":   "carol@example.com",
+	})
+	pod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "web", Labels: map[string]string{"app": "web"}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+	}
+	clientset := clientFake.NewSimpleClientset(pod("web-1"), pod("web-2"))
+	clientset.PrependReactor("create", "subjectaccessreviews", allowPods("web-2"))
+
+	fs, _, err := newSFTPHandler(clientset, &fake.RESTClient{}, &rest.Config{}, newLocalExecutor, "web-carol", "")
+	require.NoError(t, err)
+	handler, ok := fs.(*SFTPHandler)
+	require.True(t, ok, "Only the pod the user may exec into is served")
+	assert.Equal(t, "web-2", handler.PodName)
+
+	k8s.SetSecretInCache("web-dave", map[string]string{
+		"service":          "web",
+		"secretNamespace":  "web",
+		"podLabelSelector": "app=web",
+		"kubernetesUser":   "dave@example.com",
+	})
+	clientset = clientFake.NewSimpleClientset(pod("web-1"))
+	clientset.PrependReactor("create", "subjectaccessreviews", allowPods())
+	_, _, err = newSFTPHandler(clientset, &fake.RESTClient{}, &rest.Config{}, newLocalExecutor, "web-dave", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "dave@example.com may not create pods/web-1/exec in namespace web")
+}
@@ -0,0 +1,277 @@
+package sshserver
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxDisconnectWarning caps how long before a timeout users are warned.
+const maxDisconnectWarning = time.Minute
+
+// connTimeouts enforces server keepalives, an idle-input timeout and a
+// maximum session lifetime on a single SSH connection. A zero duration
+// disables the corresponding check; all methods are safe on a nil receiver.
+type connTimeouts struct {
+	conn              ssh.Conn
+	keepaliveInterval time.Duration
+	keepaliveCountMax int
+	idleTimeout       time.Duration
+	started           time.Time
+	tick              time.Duration
+
+	mu             sync.Mutex
+	deadline       time.Time
+	deadlineReason string
+	lastInput      time.Time
+	channels       map[ssh.Channel]struct{}
+	idleWarned     bool
+	limitWarned    bool
+
+	pendingKeepalives int32
+	done              chan struct{}
+	stopOnce          sync.Once
+	watchOnce         sync.Once
+}
+
+// newConnTimeouts resolves the user's settings, falling back to the router
+// defaults. Routes may only tighten the router's idle and duration limits.
+func newConnTimeouts(conn ssh.Conn, opts Options) *connTimeouts {
+	now := time.Now()
+	t := &connTimeouts{
+		conn:              conn,
+		keepaliveInterval: opts.KeepaliveInterval,
+		keepaliveCountMax: opts.KeepaliveCountMax,
+		idleTimeout:       opts.IdleTimeout,
+		started:           now,
+		tick:              time.Second,
+		lastInput:         now,
+		channels:          make(map[ssh.Channel]struct{}),
+		done:              make(chan struct{}),
+	}
+	maxSessionDuration := opts.MaxSessionDuration
+
+	if secret, err := k8s.GetUserSecret(conn.User()); err == nil {
+		t.keepaliveInterval = userDuration(secret, "keepaliveInterval", t.keepaliveInterval)
+		t.idleTimeout = userLimit(secret, "idleTimeout", t.idleTimeout)
+		maxSessionDuration = userLimit(secret, "maxSessionDuration", maxSessionDuration)
+	}
+	if maxSessionDuration > 0 {
+		t.deadline = now.Add(maxSessionDuration)
+		t.deadlineReason = "maximum session duration reached"
+	}
+	if t.keepaliveCountMax <= 0 {
+		t.keepaliveCountMax = 3
+	}
+	return t
+}
+
+// userDuration reads a duration override from the user's route.
+func userDuration(secret map[string]string, key string, fallback time.Duration) time.Duration {
+	value := secret[key]
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Ignoring invalid %s %q: %v", key, value, err)
+		return fallback
+	}
+	return d
+}
+
+// userLimit reads a timeout override from the user's route that can only
+// tighten limit: the smaller of the two applies, and 0 only disables the
+// timeout when the router sets none.
+func userLimit(secret map[string]string, key string, limit time.Duration) time.Duration {
+	d := userDuration(secret, key, limit)
+	if limit > 0 && (d == 0 || d > limit) {
+		return limit
+	}
+	return d
+}
+
+// disconnectWarning is how long before a timeout of length d users are warned.
+func disconnectWarning(d time.Duration) time.Duration {
+	if warning := d / 10; warning < maxDisconnectWarning {
+		return warning
+	}
+	return maxDisconnectWarning
+}
+
+// start runs the keepalive and timeout loops until stop is called.
+func (t *connTimeouts) start() {
+	if t == nil {
+		return
+	}
+	if t.keepaliveInterval > 0 {
+		go t.keepalive()
+	}
+	if t.idleTimeout > 0 || !t.deadline.IsZero() {
+		t.watchOnce.Do(func() { go t.watch() })
+	}
+}
+
+// limit ends the session at deadline with reason, unless an earlier deadline
+// already applies.
+func (t *connTimeouts) limit(deadline time.Time, reason string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.deadline.IsZero() || deadline.Before(t.deadline) {
+		t.deadline = deadline
+		t.deadlineReason = reason
+		t.limitWarned = false
+	}
+	t.mu.Unlock()
+	t.watchOnce.Do(func() { go t.watch() })
+}
+
+func (t *connTimeouts) stop() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.done) })
+}
+
+// track records input on channel as activity and makes it receive
+// disconnect warnings until it is closed.
+func (t *connTimeouts) track(channel ssh.Channel) ssh.Channel {
+	if t == nil {
+		return channel
+	}
+	t.mu.Lock()
+	t.channels[channel] = struct{}{}
+	t.mu.Unlock()
+	return &trackedChannel{Channel: channel, timeouts: t}
+}
+
+// trackInput records input on a forwarding channel as activity. Forwarding
+// channels have no stderr, so they never receive warnings.
+func (t *connTimeouts) trackInput(channel ssh.Channel) ssh.Channel {
+	if t == nil {
+		return channel
+	}
+	return &trackedChannel{Channel: channel, timeouts: t}
+}
+
+func (t *connTimeouts) touch() {
+	t.mu.Lock()
+	t.lastInput = time.Now()
+	t.idleWarned = false
+	t.mu.Unlock()
+}
+
+func (t *connTimeouts) untrack(channel ssh.Channel) {
+	t.mu.Lock()
+	delete(t.channels, channel)
+	t.mu.Unlock()
+}
+
+// keepalive probes the client and drops the connection once
+// keepaliveCountMax probes in a row went unanswered.
+func (t *connTimeouts) keepalive() {
+	ticker := time.NewTicker(t.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+
+		if atomic.LoadInt32(&t.pendingKeepalives) >= int32(t.keepaliveCountMax) {
+			log.Printf("Keepalive timeout for %s from %s", t.conn.User(), t.conn.RemoteAddr())
+			t.conn.Close()
+			return
+		}
+		atomic.AddInt32(&t.pendingKeepalives, 1)
+		go func() {
+			// Any reply, even a failure, proves the client is alive
+			if _, _, err := t.conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+				atomic.StoreInt32(&t.pendingKeepalives, 0)
+			}
+		}()
+	}
+}
+
+// watch warns about and then enforces the idle timeout and session deadline.
+func (t *connTimeouts) watch() {
+	ticker := time.NewTicker(t.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+
+		t.mu.Lock()
+		deadline, deadlineReason := t.deadline, t.deadlineReason
+		idleDeadline := t.lastInput.Add(t.idleTimeout)
+		warnIdle := t.idleTimeout > 0 && !t.idleWarned && !now.Before(idleDeadline.Add(-disconnectWarning(t.idleTimeout)))
+		warnLimit := !deadline.IsZero() && !t.limitWarned && !now.Before(deadline.Add(-disconnectWarning(deadline.Sub(t.started))))
+		t.idleWarned = t.idleWarned || warnIdle
+		t.limitWarned = t.limitWarned || warnLimit
+		t.mu.Unlock()
+
+		switch {
+		case !deadline.IsZero() && !now.Before(deadline):
+			t.disconnect(deadlineReason)
+			return
+		case t.idleTimeout > 0 && !now.Before(idleDeadline):
+			t.disconnect(fmt.Sprintf("idle for %s", t.idleTimeout))
+			return
+		case warnLimit:
+			t.warn(fmt.Sprintf("%s, disconnecting in %s", deadlineReason, deadline.Sub(now).Round(time.Second)))
+		case warnIdle:
+			t.warn(fmt.Sprintf("session idle, disconnecting in %s without input", idleDeadline.Sub(now).Round(time.Second)))
+		}
+	}
+}
+
+// warn writes a line to the stderr of every open session.
+func (t *connTimeouts) warn(msg string) {
+	t.mu.Lock()
+	channels := make([]ssh.Channel, 0, len(t.channels))
+	for channel := range t.channels {
+		channels = append(channels, channel)
+	}
+	t.mu.Unlock()
+
+	for _, channel := range channels {
+		fmt.Fprintf(channel.Stderr(), "\r\nk8s-ssh-router: %s\r\n", msg)
+	}
+}
+
+func (t *connTimeouts) disconnect(reason string) {
+	log.Printf("Disconnecting %s from %s: %s", t.conn.User(), t.conn.RemoteAddr(), reason)
+	t.warn("disconnecting: " + reason)
+	t.conn.Close()
+}
+
+// trackedChannel reports reads to its connTimeouts.
+type trackedChannel struct {
+	ssh.Channel
+	timeouts *connTimeouts
+}
+
+func (c *trackedChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	if n > 0 {
+		c.timeouts.touch()
+	}
+	return n, err
+}
+
+func (c *trackedChannel) Close() error {
+	c.timeouts.untrack(c.Channel)
+	return c.Channel.Close()
+}
@@ -0,0 +1,286 @@
+package sshserver
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidcollom/k8s-ssh-router/pkg/k8s"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+// newTestConnPair connects an SSH client and server over loopback TCP.
+func newTestConnPair(t *testing.T, user string) (*ssh.ServerConn, <-chan ssh.NewChannel, ssh.Conn, <-chan *ssh.Request) {
+	privateBytes, err := generatePrivateKey()
+	require.NoError(t, err, "Failed to generate private key")
+	signer, err := ssh.ParsePrivateKey(privateBytes)
+	require.NoError(t, err, "Failed to parse private key")
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverSide, err := listener.Accept()
+	require.NoError(t, err)
+	type serverResult struct {
+		conn  *ssh.ServerConn
+		chans <-chan ssh.NewChannel
+		err   error
+	}
+	results := make(chan serverResult, 1)
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		results <- serverResult{conn, chans, err}
+	}()
+
+	clientConn, clientChans, clientReqs, err := ssh.NewClientConn(clientSide, "pipe", &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	go func() {
+		for newChannel := range clientChans {
+			newChannel.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	result := <-results
+	require.NoError(t, result.err)
+	t.Cleanup(func() {
+		clientConn.Close()
+		result.conn.Close()
+	})
+	return result.conn, result.chans, clientConn, clientReqs
+}
+
+// openTrackedSession opens a session from the client and tracks it on the server.
+func openTrackedSession(t *testing.T, timeouts *connTimeouts, serverChans <-chan ssh.NewChannel, clientConn ssh.Conn) (ssh.Channel, *syncBuffer) {
+	accepted := make(chan ssh.Channel, 1)
+	go func() {
+		newChannel := <-serverChans
+		channel, reqs, err := newChannel.Accept()
+		require.NoError(t, err)
+		go ssh.DiscardRequests(reqs)
+		accepted <- timeouts.track(channel)
+	}()
+
+	clientChannel, reqs, err := clientConn.OpenChannel("session", nil)
+	require.NoError(t, err)
+	go ssh.DiscardRequests(reqs)
+
+	stderr := &syncBuffer{}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := clientChannel.Stderr().Read(buf)
+			stderr.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return clientChannel, stderr
+}
+
+func waitClosed(conn ssh.Conn) chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+	return closed
+}
+
+func TestConnTimeoutsUserOverrides(t *testing.T) {
+	k8s.SetSecretInCache("default-timeoutuser", map[string]string{
+		"idleTimeout":        "5m",
+		"maxSessionDuration": "1h",
+		"keepaliveInterval":  "bogus",
+	})
+	serverConn, _, _, _ := newTestConnPair(t, "default-timeoutuser")
+
+	timeouts := newConnTimeouts(serverConn, Options{
+		KeepaliveInterval: 15 * time.Second,
+		IdleTimeout:       10 * time.Minute,
+	})
+	assert.Equal(t, 15*time.Second, timeouts.keepaliveInterval, "Invalid overrides should fall back to the router default")
+	assert.Equal(t, 5*time.Minute, timeouts.idleTimeout)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), timeouts.deadline, time.Second)
+	assert.Equal(t, 3, timeouts.keepaliveCountMax)
+}
+
+func TestConnTimeoutsUserOverridesOnlyTighten(t *testing.T) {
+	k8s.SetSecretInCache("default-lenientuser", map[string]string{
+		"idleTimeout":        "0",
+		"maxSessionDuration": "24h",
+	})
+	serverConn, _, _, _ := newTestConnPair(t, "default-lenientuser")
+
+	timeouts := newConnTimeouts(serverConn, Options{IdleTimeout: time.Minute, MaxSessionDuration: time.Hour})
+	assert.Equal(t, time.Minute, timeouts.idleTimeout, "Routes may not disable the router's idle timeout")
+	assert.WithinDuration(t, time.Now().Add(time.Hour), timeouts.deadline, time.Second, "Routes may not extend the router's maximum duration")
+
+	timeouts = newConnTimeouts(serverConn, Options{})
+	assert.Zero(t, timeouts.idleTimeout)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), timeouts.deadline, time.Second, "Routes set limits the router leaves unset")
+}
+
+func TestConnTimeoutsIdle(t *testing.T) {
+	serverConn, serverChans, clientConn, _ := newTestConnPair(t, "default-nobody")
+	timeouts := newConnTimeouts(serverConn, Options{IdleTimeout: 600 * time.Millisecond})
+	timeouts.tick = 10 * time.Millisecond
+	_, stderr := openTrackedSession(t, timeouts, serverChans, clientConn)
+
+	closed := waitClosed(clientConn)
+	timeouts.start()
+	defer timeouts.stop()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle connection was not closed")
+	}
+	// The final warning may still be in flight when the connection closes
+	assert.Eventually(t, func() bool {
+		return strings.Contains(stderr.String(), "disconnecting: idle for 600ms")
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, stderr.String(), "session idle, disconnecting in")
+}
+
+func TestConnTimeoutsInputResetsIdle(t *testing.T) {
+	serverConn, serverChans, clientConn, _ := newTestConnPair(t, "default-nobody")
+	timeouts := newConnTimeouts(serverConn, Options{IdleTimeout: 300 * time.Millisecond})
+	timeouts.tick = 10 * time.Millisecond
+	clientChannel, _ := openTrackedSession(t, timeouts, serverChans, clientConn)
+
+	// Drain the tracked side so client writes register as input
+	timeouts.mu.Lock()
+	var serverChannel ssh.Channel
+	for channel := range timeouts.channels {
+		serverChannel = channel
+	}
+	timeouts.mu.Unlock()
+	tracked := &trackedChannel{Channel: serverChannel, timeouts: timeouts}
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := tracked.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	closed := waitClosed(clientConn)
+	timeouts.start()
+	defer timeouts.stop()
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err := clientChannel.Write([]byte("x"))
+		require.NoError(t, err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Connection with regular input should stay open")
+	default:
+	}
+}
+
+func TestConnTimeoutsMaxSessionDuration(t *testing.T) {
+	serverConn, serverChans, clientConn, _ := newTestConnPair(t, "default-nobody")
+	timeouts := newConnTimeouts(serverConn, Options{MaxSessionDuration: 500 * time.Millisecond})
+	timeouts.tick = 10 * time.Millisecond
+	_, stderr := openTrackedSession(t, timeouts, serverChans, clientConn)
+
+	closed := waitClosed(clientConn)
+	timeouts.start()
+	defer timeouts.stop()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection outliving its maximum duration was not closed")
+	}
+	assert.True(t, strings.Contains(stderr.String(), "maximum session duration reached, disconnecting in"))
+}
+
+func TestConnTimeoutsKeepalive(t *testing.T) {
+	// The client never services global requests, like a peer that vanished behind NAT
+	serverConn, _, clientConn, _ := newTestConnPair(t, "default-nobody")
+	timeouts := newConnTimeouts(serverConn, Options{KeepaliveInterval: 50 * time.Millisecond, KeepaliveCountMax: 2})
+
+	closed := waitClosed(clientConn)
+	timeouts.start()
+	defer timeouts.stop()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unresponsive client was not disconnected")
+	}
+}
+
+func TestConnTimeoutsKeepaliveAnswered(t *testing.T) {
+	serverConn, _, clientConn, clientReqs := newTestConnPair(t, "default-nobody")
+	go ssh.DiscardRequests(clientReqs)
+	timeouts := newConnTimeouts(serverConn, Options{KeepaliveInterval: 50 * time.Millisecond, KeepaliveCountMax: 2})
+
+	closed := waitClosed(clientConn)
+	timeouts.start()
+	defer timeouts.stop()
+
+	select {
+	case <-closed:
+		t.Fatal("Responsive client should not be disconnected")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestConnTimeoutsLimit(t *testing.T) {
+	serverConn, serverChans, clientConn, _ := newTestConnPair(t, "default-nobody")
+	timeouts := newConnTimeouts(serverConn, Options{MaxSessionDuration: time.Hour})
+	timeouts.tick = 10 * time.Millisecond
+	_, stderr := openTrackedSession(t, timeouts, serverChans, clientConn)
+
+	closed := waitClosed(clientConn)
+	timeouts.start()
+	defer timeouts.stop()
+	timeouts.limit(time.Now().Add(2*time.Hour), "later deadline")
+	timeouts.limit(time.Now().Add(500*time.Millisecond), "access approval expired")
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection outliving its limit was not closed")
+	}
+	assert.Contains(t, stderr.String(), "access approval expired, disconnecting in")
+	assert.NotContains(t, stderr.String(), "later deadline", "Later limits must not extend the session")
+}